@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Connection handling of the bridge's own HTTP API
+*/
+
+type ApiServerConfig struct {
+	// keep connections to the bridge open between requests (default true)
+	KeepAlive *bool `json:"keepAlive"`
+	// close connections idle for longer than this, 0 keeps them open
+	IdleTimeoutMs int `json:"idleTimeoutMs"`
+	// maximum number of simultaneous connections, 0 for no limit
+	MaxConnections int `json:"maxConnections"`
+	// close a connection after serving this many requests, 0 for no limit
+	MaxRequestsPerConn int `json:"maxRequestsPerConn"`
+	// let in-flight requests finish for up to this long when StopServer is called, 0 closes immediately
+	ShutdownDrainTimeoutMs int `json:"shutdownDrainTimeoutMs"`
+}
+
+var (
+	apiLock     sync.Mutex
+	apiServer   *http.Server
+	apiListener *limitListener
+)
+
+type connRequestsKey struct{}
+
+func getApiServerConfig() ApiServerConfig {
+	if config := getServerConfig().Api; config != nil {
+		return *config
+	}
+	return ApiServerConfig{}
+}
+
+// newApiServer wraps handler in a server honoring the api config
+func newApiServer(handler http.Handler) *http.Server {
+	idle := newIdleTracker()
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if max := getApiServerConfig().MaxRequestsPerConn; max > 0 {
+				if served, ok := r.Context().Value(connRequestsKey{}).(*int64); ok && atomic.AddInt64(served, 1) >= int64(max) {
+					w.Header().Set("Connection", "close")
+				}
+			}
+			handler.ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connRequestsKey{}, new(int64))
+		},
+		ConnState: idle.track,
+	}
+}
+
+// startApiServer wraps listener in the api server and publishes both before anything is served,
+// so config changes and StopServer always see the running server
+func startApiServer(listener net.Listener) (*http.Server, *limitListener) {
+	server, limited := newApiServer(requireAuth(http.DefaultServeMux)), newLimitListener(listener)
+	apiLock.Lock()
+	apiServer, apiListener = server, limited
+	apiLock.Unlock()
+	applyApiServerConfig(getServerConfig().Api)
+	return server, limited
+}
+
+func getApiServer() (*http.Server, *limitListener) {
+	apiLock.Lock()
+	defer apiLock.Unlock()
+	return apiServer, apiListener
+}
+
+// applyApiServerConfig pushes config changes to the running server
+func applyApiServerConfig(config *ApiServerConfig) {
+	keepAlive := config == nil || config.KeepAlive == nil || *config.KeepAlive
+	apiServer, apiListener := getApiServer()
+	if apiServer != nil {
+		apiServer.SetKeepAlivesEnabled(keepAlive)
+	}
+	if apiListener != nil {
+		apiListener.wake()
+	}
+}
+
+// stopServer shuts the api server down, draining in-flight requests for up to drainTimeout
+func stopServer(drainTimeout time.Duration) error {
+	applyForwardProxy(nil)
+	closeDialShims()
+	apiServer, _ := getApiServer()
+	if apiServer == nil {
+		return nil
+	}
+	if drainTimeout <= 0 {
+		return apiServer.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err := apiServer.Shutdown(ctx)
+	if err != nil {
+		// drain timed out, drop whatever is left
+		apiServer.Close()
+	}
+	return err
+}
+
+// idleTracker closes connections that stay idle for longer than the configured timeout
+type idleTracker struct {
+	mu     sync.Mutex
+	timers map[net.Conn]*time.Timer
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{timers: make(map[net.Conn]*time.Timer)}
+}
+
+func (t *idleTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.timers[c]; ok {
+		timer.Stop()
+		delete(t.timers, c)
+	}
+	if state != http.StateIdle {
+		return
+	}
+	if timeout := getApiServerConfig().IdleTimeoutMs; timeout > 0 {
+		t.timers[c] = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			c.Close()
+		})
+	}
+}
+
+// limitListener caps the number of open connections, reading the limit from the api config
+type limitListener struct {
+	net.Listener
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	closed bool
+}
+
+func newLimitListener(l net.Listener) *limitListener {
+	ll := &limitListener{Listener: l}
+	ll.cond = sync.NewCond(&ll.mu)
+	return ll
+}
+
+func (l *limitListener) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if l.closed {
+			return false
+		}
+		max := getApiServerConfig().MaxConnections
+		if max <= 0 || l.active < max {
+			l.active++
+			return true
+		}
+		l.cond.Wait()
+	}
+}
+
+func (l *limitListener) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+// wake re-evaluates waiting accepts after the limit changed
+func (l *limitListener) wake() {
+	l.cond.Broadcast()
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: l.release}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.cond.Broadcast()
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sync/atomic"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Shared secret required on every call to the bridge API
+*/
+
+const authTokenHeader = "X-Bridge-Token"
+
+var authToken atomic.Pointer[string]
+
+// setAuthToken sets the token callers have to present, generating one if token is empty
+func setAuthToken(token string) string {
+	if token == "" {
+		token = randomHex(32)
+	}
+	authToken.Store(&token)
+	return token
+}
+
+// requireAuth rejects requests that don't carry the bridge token
+func requireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := authToken.Load()
+		if token != nil && subtle.ConstantTimeCompare([]byte(r.Header.Get(authTokenHeader)), []byte(*token)) != 1 {
+			http.Error(w, "Missing or invalid "+authTokenHeader+" header", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
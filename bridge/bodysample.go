@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Sampling of large bodies: only the first and last bytes are kept, along with the length and hash
+of the whole body, so huge files can be sniffed or watched for changes without sending them back
+*/
+
+type BodySampleInput struct {
+	// bytes kept from the start of the body
+	Head int64 `json:"head"`
+	// bytes kept from the end of the body
+	Tail int64 `json:"tail"`
+}
+
+// BodySample replaces the body of a response fetched with bodySample
+type BodySample struct {
+	// first bytes of the body, encoded like the response body
+	Head string `json:"head"`
+	// last bytes of the body not already in Head, encoded like the response body
+	Tail string `json:"tail"`
+	// length of the whole body after decompression
+	TotalBytes int64 `json:"totalBytes"`
+	// digest of the whole body, "sha-256=base64". Can be passed back as expectedDigest
+	Digest string `json:"digest"`
+	// content type sniffed from Head
+	DetectedType string `json:"detectedType"`
+}
+
+// bodySampler keeps the head of everything written to it and a ring buffer of its tail
+type bodySampler struct {
+	head  []byte
+	tail  []byte
+	limit int64
+	// next write position in tail once it is full
+	next  int
+	total int64
+	hash  hash.Hash
+}
+
+func newBodySampler(input *BodySampleInput) (*bodySampler, error) {
+	if input.Head < 0 || input.Tail < 0 {
+		return nil, fmt.Errorf("bodySample head and tail can't be negative")
+	}
+	return &bodySampler{
+		head:  make([]byte, 0, min(input.Head, 64*1024)),
+		limit: input.Head,
+		// the ring buffer needs its full size up front
+		tail: make([]byte, 0, input.Tail),
+		next: -1,
+		hash: sha256.New(),
+	}, nil
+}
+
+func (s *bodySampler) Write(p []byte) (int, error) {
+	n := len(p)
+	s.total += int64(n)
+	s.hash.Write(p)
+	if room := s.limit - int64(len(s.head)); room > 0 {
+		take := min(room, int64(len(p)))
+		s.head = append(s.head, p[:take]...)
+		p = p[take:]
+	}
+	s.writeTail(p)
+	return n, nil
+}
+
+func (s *bodySampler) writeTail(p []byte) {
+	size := cap(s.tail)
+	if s.next < 0 {
+		// still filling up
+		room := int(min(int64(size-len(s.tail)), int64(len(p))))
+		s.tail = append(s.tail, p[:room]...)
+		p = p[room:]
+		if len(p) == 0 && len(s.tail) < size {
+			return
+		}
+		s.next = 0
+	}
+	if size == 0 {
+		return
+	}
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		copied := copy(s.tail[s.next:], p)
+		p = p[copied:]
+		s.next = (s.next + copied) % size
+	}
+}
+
+// tailBytes returns the tail in order
+func (s *bodySampler) tailBytes() []byte {
+	if s.next <= 0 {
+		return s.tail
+	}
+	return append(append([]byte{}, s.tail[s.next:]...), s.tail[:s.next]...)
+}
+
+// sampleBody reads body to the end, keeping only what input asks for
+func sampleBody(body io.Reader, input *BodySampleInput, contentType string, isByteResponse bool) (*BodySample, error) {
+	sampler, err := newBodySampler(input)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(sampler, body); err != nil {
+		return nil, err
+	}
+
+	head, tail := sampler.head, sampler.tailBytes()
+	sample := &BodySample{
+		TotalBytes:   sampler.total,
+		Digest:       "sha-256=" + base64.StdEncoding.EncodeToString(sampler.hash.Sum(nil)),
+		DetectedType: http.DetectContentType(head),
+	}
+	if isByteResponse {
+		sample.Head = fmt.Sprintf("data:%s;base64,", sample.DetectedType) + base64.StdEncoding.EncodeToString(head)
+		sample.Tail = "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(tail)
+	} else {
+		sample.Head, _ = decodeBody(head, contentType)
+		sample.Tail, _ = decodeBody(tail, contentType)
+	}
+	return sample, nil
+}
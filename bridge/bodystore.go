@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Response bodies kept by the bridge under their response id, so the Python client can read slices
+of a large body again and again without it crossing the JSON bridge every time
+*/
+
+const (
+	defaultBodyStoreMaxBytes   = 256 * 1024 * 1024
+	defaultBodyStoreTtlSeconds = 600
+)
+
+type BodyStoreConfig struct {
+	// total size of the stored bodies, the least recently read ones are dropped beyond it (default 256 MiB)
+	MaxBytes int64 `json:"maxBytes"`
+	// drop bodies not read for this many seconds (default 600)
+	TtlSeconds int `json:"ttlSeconds"`
+}
+
+// StoredBody replaces the body of a response fetched with storeBody
+type StoredBody struct {
+	// the response id, read the body back with GET /body/{id}?offset=&length=
+	Id string `json:"id"`
+	// length of the body after decompression
+	TotalBytes int64 `json:"totalBytes"`
+	// content type sniffed from the start of the body
+	DetectedType string `json:"detectedType"`
+}
+
+// BodyStoreFullError is returned when a body alone is larger than the whole store
+type BodyStoreFullError struct {
+	Size     int64
+	MaxBytes int64
+}
+
+func (e *BodyStoreFullError) Error() string {
+	return fmt.Sprintf("body of %d bytes exceeds bodyStore.maxBytes of %d bytes", e.Size, e.MaxBytes)
+}
+
+type storedBody struct {
+	id          string
+	data        []byte
+	contentType string
+	lastRead    time.Time
+}
+
+// bodyStore holds bodies in least recently read order, the front being the oldest
+type bodyStore struct {
+	mu     sync.Mutex
+	bodies map[string]*list.Element
+	order  *list.List
+	size   int64
+}
+
+var storedBodies = &bodyStore{bodies: make(map[string]*list.Element), order: list.New()}
+
+func getBodyStoreConfig() BodyStoreConfig {
+	config := BodyStoreConfig{}
+	if c := getServerConfig().BodyStore; c != nil {
+		config = *c
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultBodyStoreMaxBytes
+	}
+	if config.TtlSeconds <= 0 {
+		config.TtlSeconds = defaultBodyStoreTtlSeconds
+	}
+	return config
+}
+
+// put stores data under id, dropping expired and least recently read bodies to make room
+func (s *bodyStore) put(id string, data []byte, contentType string) (*StoredBody, error) {
+	config := getBodyStoreConfig()
+	size := int64(len(data))
+	if size > config.MaxBytes {
+		return nil, &BodyStoreFullError{Size: size, MaxBytes: config.MaxBytes}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Duration(config.TtlSeconds) * time.Second)
+	for s.size+size > config.MaxBytes {
+		s.remove(s.order.Front())
+	}
+	if element, ok := s.bodies[id]; ok {
+		s.remove(element)
+	}
+	s.bodies[id] = s.order.PushBack(&storedBody{id: id, data: data, contentType: contentType, lastRead: time.Now()})
+	s.size += size
+	return &StoredBody{Id: id, TotalBytes: size, DetectedType: http.DetectContentType(data)}, nil
+}
+
+// get returns the body stored under id, marking it as read
+func (s *bodyStore) get(id string) (*storedBody, bool) {
+	config := getBodyStoreConfig()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Duration(config.TtlSeconds) * time.Second)
+	element, ok := s.bodies[id]
+	if !ok {
+		return nil, false
+	}
+	body := element.Value.(*storedBody)
+	body.lastRead = time.Now()
+	s.order.MoveToBack(element)
+	return body, true
+}
+
+// delete drops the body stored under id, returning how many bytes it freed
+func (s *bodyStore) delete(id string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.bodies[id]
+	if !ok {
+		return 0, false
+	}
+	size := int64(len(element.Value.(*storedBody).data))
+	s.remove(element)
+	return size, true
+}
+
+// expire drops bodies not read within ttl, must be called with s.mu held
+func (s *bodyStore) expire(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+	for element := s.order.Front(); element != nil; element = s.order.Front() {
+		if element.Value.(*storedBody).lastRead.After(cutoff) {
+			return
+		}
+		s.remove(element)
+	}
+}
+
+// remove must be called with s.mu held
+func (s *bodyStore) remove(element *list.Element) {
+	body := element.Value.(*storedBody)
+	s.order.Remove(element)
+	delete(s.bodies, body.id)
+	s.size -= int64(len(body.data))
+}
+
+// flush drops every stored body, returning how many there were
+func (s *bodyStore) flush() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := len(s.bodies)
+	s.bodies = make(map[string]*list.Element)
+	s.order.Init()
+	s.size = 0
+	return count
+}
+
+type BodyDeleteOutput struct {
+	Id string `json:"id"`
+	// bytes released by the store
+	Freed int64 `json:"freed"`
+}
+
+func bodyHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		GET /body/{id}?offset=&length= returns a slice of a stored body as is, DELETE /body/{id} drops it.
+		The slice covers the rest of the body when length is left out
+	*/
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/body/"), "/")
+	switch r.Method {
+	case http.MethodGet:
+		readStoredBody(w, r, id)
+	case http.MethodDelete:
+		freed, ok := storedBodies.delete(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no body stored for id: %s", id), http.StatusNotFound)
+			return
+		}
+		writeJson(w, BodyDeleteOutput{Id: id, Freed: freed})
+	default:
+		http.Error(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func readStoredBody(w http.ResponseWriter, r *http.Request, id string) {
+	body, ok := storedBodies.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no body stored for id: %s", id), http.StatusNotFound)
+		return
+	}
+	total := int64(len(body.data))
+
+	query := r.URL.Query()
+	offset, length := int64(0), total
+	var err error
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 {
+			http.Error(w, fmt.Sprintf("invalid offset: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("length"); value != "" {
+		if length, err = strconv.ParseInt(value, 10, 64); err != nil || length < 0 {
+			http.Error(w, fmt.Sprintf("invalid length: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if offset > total {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		http.Error(w, fmt.Sprintf("offset %d is past the end of the %d byte body", offset, total), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	end := total
+	if length < total-offset {
+		end = offset + length
+	}
+
+	contentType := body.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(end-offset, 10))
+	if end > offset {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, total))
+	} else {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	}
+	w.Write(body.data[offset:end])
+}
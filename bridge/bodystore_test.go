@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestStoredBody(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	response := finalResponse(t, bridgeRequest(t, map[string]any{
+		"requestUrl": server.URL + "/slow?chunks=10",
+		"storeBody":  true,
+	}))
+	if response.Body != "" || response.StoredBody == nil || response.StoredBody.TotalBytes != 10 {
+		t.Fatalf("body %q stored as %+v, want 10 bytes kept by the bridge", response.Body, response.StoredBody)
+	}
+	path := "/body/" + response.StoredBody.Id
+
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", 200, "xxxxxxxxxx"},
+		{"?offset=7", 200, "xxx"},
+		{"?offset=2&length=3", 200, "xxx"},
+		{"?offset=8&length=100", 200, "xx"},
+		{"?offset=11", 416, ""},
+		{"?length=-1", 400, ""},
+	}
+	for _, test := range tests {
+		resp, body := bridgeDo(t, "GET", path+test.query)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s answered %d, want %d", test.query, resp.StatusCode, test.status)
+		} else if test.status == 200 && string(body) != test.body {
+			t.Errorf("%s returned %q, want %q", test.query, body, test.body)
+		}
+	}
+
+	// flushing caches leaves stored bodies alone unless asked to drop them too
+	if resp, _ := bridgeDo(t, "POST", "/maintenance/flush"); resp.StatusCode != 200 {
+		t.Errorf("flush answered %d", resp.StatusCode)
+	}
+	if resp, _ := bridgeDo(t, "GET", path); resp.StatusCode != 200 {
+		t.Errorf("read after flush answered %d, want 200", resp.StatusCode)
+	}
+
+	if resp, _ := bridgeDo(t, "DELETE", path); resp.StatusCode != 200 {
+		t.Errorf("delete answered %d", resp.StatusCode)
+	}
+	if resp, _ := bridgeDo(t, "GET", path); resp.StatusCode != 404 {
+		t.Errorf("read after delete answered %d, want 404", resp.StatusCode)
+	}
+
+	response = finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/slow?chunks=1", "storeBody": true}))
+	bridgeDo(t, "POST", "/maintenance/flush?storedBodies=true")
+	if resp, _ := bridgeDo(t, "GET", "/body/"+response.StoredBody.Id); resp.StatusCode != 404 {
+		t.Errorf("read after flushing stored bodies answered %d, want 404", resp.StatusCode)
+	}
+}
@@ -1,3 +1,4 @@
 set /p ver=<VERSION
 
+REM slim build without the optional subsystems: add --tags=no_extraction,no_forwardproxy (see capabilities.go)
 xgo --out=hrequests-cgo-%ver% -buildmode=c-shared --dest=./dist .
\ No newline at end of file
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"sort"
+	"strconv"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Decoding of multipart/byteranges bodies sent in answer to multi-range requests
+*/
+
+// ByteRange is one part of a multipart/byteranges response
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// complete length of the resource, -1 when the server didn't know it
+	Total       int64  `json:"total"`
+	ContentType string `json:"contentType,omitempty"`
+	// the part's data, encoded like the response body. Empty when the parts were joined into the body
+	Body string `json:"body,omitempty"`
+	data []byte
+}
+
+// parseByteRanges splits a multipart/byteranges body into its parts, sorted by offset.
+// Returns nil if the body isn't multipart/byteranges
+func parseByteRanges(body []byte, contentType string) ([]*ByteRange, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		return nil, nil
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var ranges []*ByteRange
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart/byteranges body: %w", err)
+		}
+		byteRange, err := parseContentRange(part.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		byteRange.ContentType = part.Header.Get("Content-Type")
+		if byteRange.data, err = io.ReadAll(part); err != nil {
+			return nil, fmt.Errorf("invalid multipart/byteranges body: %w", err)
+		}
+		ranges = append(ranges, byteRange)
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	return ranges, nil
+}
+
+// parseContentRange reads "bytes start-end/total", with total possibly "*"
+func parseContentRange(value string) (*ByteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return nil, fmt.Errorf("invalid Content-Range in byterange part: %q", value)
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	start, end, ok2 := strings.Cut(span, "-")
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("invalid Content-Range in byterange part: %q", value)
+	}
+	byteRange := &ByteRange{Total: -1}
+	var err error
+	if byteRange.Start, err = strconv.ParseInt(strings.TrimSpace(start), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid Content-Range in byterange part: %q", value)
+	}
+	if byteRange.End, err = strconv.ParseInt(strings.TrimSpace(end), 10, 64); err != nil || byteRange.End < byteRange.Start {
+		return nil, fmt.Errorf("invalid Content-Range in byterange part: %q", value)
+	}
+	if total = strings.TrimSpace(total); total != "*" {
+		if byteRange.Total, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid Content-Range in byterange part: %q", value)
+		}
+	}
+	return byteRange, nil
+}
+
+// joinByteRanges concatenates ranges that together cover one contiguous span, dropping overlaps.
+// Returns false if there is a gap between two parts
+func joinByteRanges(ranges []*ByteRange) ([]byte, bool) {
+	if len(ranges) == 0 {
+		return nil, false
+	}
+	joined := append([]byte{}, ranges[0].data...)
+	end := ranges[0].End
+	for _, byteRange := range ranges[1:] {
+		if byteRange.Start > end+1 {
+			return nil, false
+		}
+		if skip := end + 1 - byteRange.Start; skip < int64(len(byteRange.data)) {
+			joined = append(joined, byteRange.data[skip:]...)
+		}
+		end = max(end, byteRange.End)
+	}
+	return joined, true
+}
+
+// encodeByteRanges fills in the part bodies, encoded the same way as the response body
+func encodeByteRanges(ranges []*ByteRange, isByteResponse bool) {
+	for _, byteRange := range ranges {
+		if isByteResponse {
+			mimeType := byteRange.ContentType
+			if mimeType == "" {
+				mimeType = http.DetectContentType(byteRange.data)
+			}
+			byteRange.Body = fmt.Sprintf("data:%s;base64,", mimeType) + base64.StdEncoding.EncodeToString(byteRange.data)
+		} else {
+			byteRange.Body, _ = decodeBody(byteRange.data, byteRange.ContentType)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *ByteRange
+	}{
+		{"bytes 0-499/1234", &ByteRange{Start: 0, End: 499, Total: 1234}},
+		{" bytes 500-999/*", &ByteRange{Start: 500, End: 999, Total: -1}},
+		{"bytes 7-7/8", &ByteRange{Start: 7, End: 7, Total: 8}},
+		{"bytes 10-5/20", nil},
+		{"bytes 0-499", nil},
+		{"bytes -499/1234", nil},
+		{"bytes 0-x/1234", nil},
+		{"bytes 0-1/many", nil},
+		{"items 0-1/2", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		got, err := parseContentRange(test.value)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q parsed as %+v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got.Start != test.want.Start || got.End != test.want.End || got.Total != test.want.Total {
+			t.Errorf("%q parsed as %+v (%v), want %+v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestJoinByteRanges(t *testing.T) {
+	part := func(start, end int64, data string) *ByteRange {
+		return &ByteRange{Start: start, End: end, data: []byte(data)}
+	}
+	tests := []struct {
+		name   string
+		ranges []*ByteRange
+		want   string
+		ok     bool
+	}{
+		{"contiguous", []*ByteRange{part(0, 2, "abc"), part(3, 5, "def")}, "abcdef", true},
+		{"overlapping", []*ByteRange{part(0, 3, "abcd"), part(2, 5, "cdef")}, "abcdef", true},
+		{"contained", []*ByteRange{part(0, 5, "abcdef"), part(1, 2, "bc")}, "abcdef", true},
+		{"gap", []*ByteRange{part(0, 2, "abc"), part(4, 5, "ef")}, "", false},
+		{"empty", nil, "", false},
+	}
+	for _, test := range tests {
+		joined, ok := joinByteRanges(test.ranges)
+		if ok != test.ok || string(joined) != test.want {
+			t.Errorf("%s: joined %q (%v), want %q (%v)", test.name, joined, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseByteRanges(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	// parts arrive out of order, as servers are free to send them
+	for _, part := range []struct{ contentRange, data string }{{"bytes 3-5/6", "def"}, {"bytes 0-2/6", "abc"}} {
+		w, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Range": {part.contentRange}, "Content-Type": {"text/plain"}})
+		w.Write([]byte(part.data))
+	}
+	writer.Close()
+
+	ranges, err := parseByteRanges(body.Bytes(), "multipart/byteranges; boundary="+writer.Boundary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].Start != 0 || ranges[1].Start != 3 || ranges[0].ContentType != "text/plain" {
+		t.Fatalf("parsed %+v, want two text/plain parts sorted by offset", ranges)
+	}
+	if joined, ok := joinByteRanges(ranges); !ok || string(joined) != "abcdef" {
+		t.Errorf("joined %q (%v), want abcdef", joined, ok)
+	}
+
+	if ranges, err := parseByteRanges([]byte("plain"), "text/plain"); ranges != nil || err != nil {
+		t.Errorf("plain body parsed as %+v (%v)", ranges, err)
+	}
+}
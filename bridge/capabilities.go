@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Optional subsystems can be compiled out with build tags for a slimmer library:
+
+	no_extraction    pipelines and their value extraction (/pipeline)
+	no_forwardproxy  the local MITM forward proxy (/forwardProxy, config.forwardProxy)
+
+e.g. go build -tags no_extraction,no_forwardproxy -buildmode=c-shared .
+Their endpoints stay registered and answer 501 Not Implemented, /capabilities lists what the build has
+*/
+
+var (
+	capabilitiesLock sync.Mutex
+	capabilities     = make(map[string]bool)
+)
+
+// registerCapability records whether an optional subsystem is compiled in, called from init
+func registerCapability(name string, present bool) {
+	capabilitiesLock.Lock()
+	defer capabilitiesLock.Unlock()
+	capabilities[name] = present
+}
+
+// CapabilityMissingError is returned when a request needs a subsystem the build doesn't have
+type CapabilityMissingError struct {
+	Name string
+}
+
+func (e *CapabilityMissingError) Error() string {
+	return fmt.Sprintf("%s is not available in this build of the bridge", e.Name)
+}
+
+type CapabilitiesOutput struct {
+	// optional subsystems mapped to whether this build has them
+	Capabilities map[string]bool `json:"capabilities"`
+	// the compiled in ones, sorted
+	Present []string `json:"present"`
+}
+
+// listCapabilities returns the optional subsystems and whether this build has them
+func listCapabilities() CapabilitiesOutput {
+	capabilitiesLock.Lock()
+	output := CapabilitiesOutput{Capabilities: make(map[string]bool, len(capabilities)), Present: []string{}}
+	for name, present := range capabilities {
+		output.Capabilities[name] = present
+		if present {
+			output.Present = append(output.Present, name)
+		}
+	}
+	capabilitiesLock.Unlock()
+	sort.Strings(output.Present)
+	return output
+}
+
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Lists the optional subsystems and whether they were compiled in
+	*/
+	writeJson(w, listCapabilities())
+}
+
+// capabilityMissing answers requests to the endpoint of a compiled out subsystem
+func capabilityMissing(w http.ResponseWriter, name string) {
+	http.Error(w, (&CapabilityMissingError{Name: name}).Error(), http.StatusNotImplemented)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+/*
+Overridable time source used for cookie expiry and generated timestamps
+*/
+
+type ClockConfig struct {
+	// shifts the bridge clock relative to the system clock
+	OffsetMs int64 `json:"offsetMs"`
+	// freezes the bridge clock at the given unix timestamp (seconds)
+	FixedTime *int64 `json:"fixedTime"`
+}
+
+var clockConfig atomic.Pointer[ClockConfig]
+
+func setClock(config *ClockConfig) {
+	clockConfig.Store(config)
+}
+
+// now returns the current time according to the bridge clock
+func now() time.Time {
+	config := clockConfig.Load()
+	if config == nil {
+		return time.Now()
+	}
+	if config.FixedTime != nil {
+		return time.Unix(*config.FixedTime, 0)
+	}
+	return time.Now().Add(time.Duration(config.OffsetMs) * time.Millisecond)
+}
+
+// cookie expiry formats seen in the wild, tried in order
+var cookieExpiresFormats = []string{
+	time.RFC1123,
+	"Mon, 02-Jan-2006 15:04:05 MST",
+	"Monday, 02-Jan-06 15:04:05 MST",
+	"Mon, 02 Jan 06 15:04:05 MST",
+	"Mon, 02-Jan-06 15:04:05 MST",
+	time.ANSIC,
+}
+
+func parseCookieExpires(raw string) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	for _, format := range cookieExpiresFormats {
+		if t, err := time.Parse(format, raw); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func cookieExpired(cookie *http.Cookie, at time.Time) bool {
+	// zero and unix epoch expiries are treated as session cookies
+	if cookie.Expires.IsZero() || cookie.Expires.Unix() <= 0 {
+		return false
+	}
+	return cookie.Expires.Before(at)
+}
+
+// clockJar wraps a cookie jar so that expiry is judged against the bridge clock.
+// It also tracks when each cookie was last set or sent, to evict the least recently used ones past the jar limits
+type clockJar struct {
+	mu  sync.Mutex
+	jar http.CookieJar
+	// last use of each cookie, keyed by jarCookieKey
+	lastUsed map[string]time.Time
+	evicted  int
+}
+
+func newClockJar(jar http.CookieJar) *clockJar {
+	return &clockJar{jar: jar, lastUsed: make(map[string]time.Time)}
+}
+
+func (j *clockJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	current := now()
+	normalized := make([]*http.Cookie, 0, len(cookies))
+	for _, cookie := range cookies {
+		c := *cookie
+		// fill in expiries the header parser could not read
+		if c.Expires.IsZero() && c.RawExpires != "" {
+			if expires, ok := parseCookieExpires(c.RawExpires); ok {
+				c.Expires = expires
+			}
+		}
+		// pin relative lifetimes to the bridge clock
+		if c.MaxAge > 0 {
+			c.Expires = current.Add(time.Duration(c.MaxAge) * time.Second)
+		} else if c.MaxAge < 0 {
+			// deletes the cookie, tls-client's jar would keep it otherwise
+			c.Expires = current.Add(-time.Second)
+		}
+		normalized = append(normalized, &c)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jar.SetCookies(u, normalized)
+	j.touch(u, normalized)
+	j.enforceLimits()
+}
+
+func (j *clockJar) Cookies(u *url.URL) []*http.Cookie {
+	current := now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var ret []*http.Cookie
+	for _, cookie := range j.jar.Cookies(u) {
+		// tls-client's jar matches cookies by host only
+		if cookie.Secure && u.Scheme != "https" {
+			continue
+		}
+		if !cookieExpired(cookie, current) {
+			ret = append(ret, cookie)
+		}
+	}
+	j.touch(u, ret)
+	return ret
+}
+
+func (j *clockJar) GetAllCookies() map[string][]*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if jar, ok := j.jar.(tls_client.CookieJar); ok {
+		return jar.GetAllCookies()
+	}
+	return nil
+}
+
+var clockJarLock sync.Mutex
+
+// installClockJar wraps the client's cookie jar in a clockJar if it isn't already
+func installClockJar(client tls_client.HttpClient) {
+	clockJarLock.Lock()
+	defer clockJarLock.Unlock()
+
+	jar := client.GetCookieJar()
+	if jar == nil {
+		return
+	}
+	if _, ok := jar.(*clockJar); ok {
+		return
+	}
+	client.SetCookieJar(newClockJar(jar))
+}
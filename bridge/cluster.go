@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Session affinity between bridge instances behind a load balancer. Session responses carry the
+id of the owning instance, and requests presenting another instance's id are forwarded to it
+*/
+
+type ClusterConfig struct {
+	// id of this instance, returned as the affinity token of its sessions
+	InstanceId string `json:"instanceId"`
+	// base urls of the other instances by id, e.g. {"b": "http://10.0.0.6:8080"}.
+	// Instances are expected to share the auth token
+	Peers map[string]string `json:"peers"`
+}
+
+var peerClient = &http.Client{Timeout: 10 * time.Minute}
+
+// getAffinity returns the affinity token handed out with session responses, or "" outside a cluster
+func getAffinity() string {
+	if config := getServerConfig().Cluster; config != nil {
+		return config.InstanceId
+	}
+	return ""
+}
+
+// setAffinity tags the session responses of a wrapper with this instance's affinity token
+func setAffinity(wrapper *ResponseWrapper) {
+	affinity := getAffinity()
+	if affinity == "" {
+		return
+	}
+	for _, response := range append([]*Response{wrapper.Response}, wrapper.History...) {
+		if response != nil && response.SessionId != "" {
+			response.Affinity = affinity
+		}
+	}
+}
+
+// ownerPeer returns the base url of the instance owning a request's session, or "" if it's this one
+func ownerPeer(params *ExtendedRequestInput) (string, error) {
+	config := getServerConfig().Cluster
+	if params.Affinity == "" || config == nil || params.Affinity == config.InstanceId {
+		return "", nil
+	}
+	peer, ok := config.Peers[params.Affinity]
+	if !ok {
+		return "", fmt.Errorf("unknown affinity %s, no such bridge instance", params.Affinity)
+	}
+	return strings.TrimSuffix(peer, "/"), nil
+}
+
+// forwardToPeer runs a request on the instance owning its session
+func forwardToPeer(ctx context.Context, peer string, params *ExtendedRequestInput) *ResponseWrapper {
+	sessionId, withSession := inputSessionId(params)
+	fail := func(err error) *ResponseWrapper {
+		forwardErr := fmt.Errorf("failed to forward request to %s: %w", peer, err)
+		return &ResponseWrapper{Response: handleErrorResponse(sessionId, withSession, phaseForward, forwardErr)}
+	}
+
+	forwarded := *params
+	// the owner handles it locally
+	forwarded.Affinity = ""
+	forwarded.CompatMode = false
+	body, err := json.Marshal(&forwarded)
+	if err != nil {
+		return fail(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/request", bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	if token := authToken.Load(); token != nil {
+		req.Header.Set(authTokenHeader, *token)
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fail(fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail))))
+	}
+
+	wrapper := &ResponseWrapper{}
+	if err := json.NewDecoder(resp.Body).Decode(wrapper); err != nil {
+		return fail(err)
+	}
+	return wrapper
+}
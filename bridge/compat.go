@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	json "github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+/*
+Compatibility shims for tooling written against the plain tls-client CFFI
+*/
+
+// CompatResponseWrapper flattens the final response into the top level of the wrapper,
+// so the payload also matches the tls-client CFFI response schema
+type CompatResponseWrapper struct {
+	*ResponseWrapper
+	*Response
+}
+
+// AddCookiesToSessionInput mirrors the tls-client CFFI input, keeping all cookie attributes
+type AddCookiesToSessionInput struct {
+	Cookies   []Cookie `json:"cookies"`
+	SessionId string   `json:"sessionId"`
+	Url       string   `json:"url"`
+}
+
+// CookiesFromSessionOutput mirrors the tls-client CFFI output, adding the cookie attributes it drops
+type CookiesFromSessionOutput struct {
+	Id      string   `json:"id"`
+	Cookies []Cookie `json:"cookies"`
+}
+
+func compatWrap(wrapper *ResponseWrapper) *CompatResponseWrapper {
+	final := wrapper.Response
+	if wrapper.IsHistory && len(wrapper.History) > 0 {
+		final = wrapper.History[len(wrapper.History)-1]
+	}
+	return &CompatResponseWrapper{wrapper, final}
+}
+
+func useCompatMode(requestInput *ExtendedRequestInput) bool {
+	return requestInput.CompatMode || getServerConfig().CompatMode
+}
+
+// wrapResponse returns the value to marshal for a single request
+func wrapResponse(requestInput *ExtendedRequestInput, wrapper *ResponseWrapper) any {
+	if useCompatMode(requestInput) {
+		return compatWrap(wrapper)
+	}
+	return wrapper
+}
+
+func destroySessionHandler(w http.ResponseWriter, r *http.Request) {
+	rawData := extractBody(w, r)
+	input := tls_client_cffi.DestroySessionInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("destroySession", err), http.StatusBadRequest)
+		return
+	}
+	DestroySession(input.SessionId)
+	writeJson(w, tls_client_cffi.DestroyOutput{Id: uuid.New().String(), Success: true})
+}
+
+func destroyAllHandler(w http.ResponseWriter, r *http.Request) {
+	if extractBody(w, r) == nil {
+		return
+	}
+	DestroyAll()
+	writeJson(w, tls_client_cffi.DestroyOutput{Id: uuid.New().String(), Success: true})
+}
+
+func getCookiesFromSessionHandler(w http.ResponseWriter, r *http.Request) {
+	rawData := extractBody(w, r)
+	input := tls_client_cffi.GetCookiesFromSessionInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("getCookiesFromSession", err), http.StatusBadRequest)
+		return
+	}
+	client, u, err := sessionClientForUrl(input.SessionId, input.Url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, CookiesFromSessionOutput{
+		Id:      uuid.New().String(),
+		Cookies: transformCookies(client.GetCookies(u)),
+	})
+}
+
+func addCookiesToSessionHandler(w http.ResponseWriter, r *http.Request) {
+	rawData := extractBody(w, r)
+	input := AddCookiesToSessionInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("addCookiesToSession", err), http.StatusBadRequest)
+		return
+	}
+	client, u, err := sessionClientForUrl(input.SessionId, input.Url)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client.SetCookies(u, buildCookies(input.Cookies))
+	writeJson(w, CookiesFromSessionOutput{
+		Id:      uuid.New().String(),
+		Cookies: transformCookies(client.GetCookies(u)),
+	})
+}
+
+func sessionClientForUrl(sessionId string, rawUrl string) (tls_client.HttpClient, *url.URL, error) {
+	client, err := tls_client_cffi.GetClient(sessionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid url: %w", err)
+	}
+	return client, u, nil
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	jsonResponse, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResponse)
+}
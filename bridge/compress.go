@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Compression of request bodies, for servers accepting compressed uploads
+*/
+
+// bodyEncoders create the writers request bodies are compressed with, by Content-Encoding
+var bodyEncoders = map[string]func(io.Writer) (io.WriteCloser, error){
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+}
+
+// compressRequestBody replaces the body of req with its compression by encoding and sets Content-Encoding.
+// Bodies are built from requestBody and already held in memory, so the compressed one is too: it keeps
+// a Content-Length, which many servers require of uploads, and can be replayed on 307 and 308 redirects
+func compressRequestBody(req *http.Request, encoding string) error {
+	newEncoder, ok := bodyEncoders[strings.ToLower(encoding)]
+	if !ok {
+		return fmt.Errorf("unsupported compressRequestBody %q, use gzip, br or zstd", encoding)
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	for key := range req.Header {
+		if strings.EqualFold(key, "Content-Encoding") {
+			return fmt.Errorf("compressRequestBody can't be used with a Content-Encoding header")
+		}
+	}
+
+	var compressed bytes.Buffer
+	encoder, err := newEncoder(&compressed)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(encoder, req.Body)
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to compress request body: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to compress request body: %w", err)
+	}
+
+	body := compressed.Bytes()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Header.Set("Content-Encoding", strings.ToLower(encoding))
+	return nil
+}
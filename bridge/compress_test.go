@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompressRequestBody(t *testing.T) {
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		for _, origin := range originProtocols {
+			t.Run(encoding+"/"+origin.protocol, func(t *testing.T) {
+				server := newOrigin(t, origin.protocol)
+				payload := strings.Repeat(`{"key": "value"}`, 100)
+				response := finalResponse(t, bridgeRequest(t, map[string]any{
+					"requestUrl":          server.URL + "/redirect/1?status=307",
+					"requestMethod":       "POST",
+					"requestBody":         payload,
+					"compressRequestBody": encoding,
+				}))
+				echo := echoed(t, response)
+				if echo["body"] != payload {
+					t.Errorf("origin decompressed %q", echo["body"])
+				}
+				headers := echo["headers"].(map[string]any)
+				if values, _ := headers["Content-Encoding"].([]any); len(values) != 1 || values[0] != encoding {
+					t.Errorf("Content-Encoding %v, want %s", headers["Content-Encoding"], encoding)
+				}
+				if values, _ := headers["Content-Length"].([]any); len(values) != 1 || values[0] == strconv.Itoa(len(payload)) {
+					t.Errorf("Content-Length %v, want the compressed size", headers["Content-Length"])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Server-wide defaults, adjustable at runtime through /config
+*/
+
+type ServerConfig struct {
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+	Clock     *ClockConfig     `json:"clock"`
+	Resolver  *ResolverConfig  `json:"resolver"`
+	Dial      *DialOptions     `json:"dial"`
+	Api       *ApiServerConfig `json:"api"`
+	// default body size limit for requests not setting maxResponseBytes
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+	// default timeoutMs and readTimeoutMs for requests not setting them
+	TimeoutMs     int `json:"timeoutMs"`
+	ReadTimeoutMs int `json:"readTimeoutMs"`
+	// cap on the request and response bodies stored in recorded HAR entries (default 64 KiB)
+	HarMaxBodyBytes int `json:"harMaxBodyBytes"`
+	// replay a share of all requests against a secondary target, proxy or profile
+	Mirror *MirrorConfig `json:"mirror"`
+	// forwarding of sessions between bridge instances
+	Cluster *ClusterConfig `json:"cluster"`
+	// size limits of session cookie jars
+	CookieJar *CookieJarConfig `json:"cookieJar"`
+	// reclaim sessions by idle time and count
+	SessionLimits *SessionLimitsConfig `json:"sessionLimits"`
+	// size and lifetime of the bodies kept for requests with storeBody
+	BodyStore *BodyStoreConfig `json:"bodyStore"`
+	// share sessions between bridge instances through Redis
+	SessionStore *SessionStoreConfig `json:"sessionStore"`
+	// local forward proxy sending browser and tool traffic through tls-client
+	ForwardProxy *ForwardProxyConfig `json:"forwardProxy"`
+	// message queues every completed response is published to
+	Sinks []SinkConfig `json:"sinks"`
+	// pace every request by the host's robots.txt
+	RespectRobots bool `json:"respectRobots"`
+	// reject payloads with unknown fields on every endpoint, see isStrict
+	StrictJson bool `json:"strictJson"`
+	// also emit the tls-client CFFI response schema
+	CompatMode bool `json:"compatMode"`
+}
+
+var (
+	configLock    sync.RWMutex
+	serverConfig  ServerConfig
+	globalLimiter *hostLimiter
+)
+
+func getServerConfig() ServerConfig {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return serverConfig
+}
+
+// clone returns a deep copy, so partial updates don't mutate the live config through shared pointers
+func (c ServerConfig) clone() ServerConfig {
+	var ret ServerConfig
+	raw, _ := json.Marshal(c)
+	json.Unmarshal(raw, &ret)
+	return ret
+}
+
+func setServerConfig(newConfig ServerConfig) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if !sameRateLimit(serverConfig.RateLimit, newConfig.RateLimit) {
+		globalLimiter = newHostLimiter(newConfig.RateLimit)
+	}
+	setClock(newConfig.Clock)
+	setSinks(newConfig.Sinks)
+	setSessionLimits(newConfig.SessionLimits)
+	serverConfig = newConfig
+}
+
+func getGlobalLimiter() *hostLimiter {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return globalLimiter
+}
+
+func sameRateLimit(a, b *RateLimitConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Updates the server config. Fields missing from the payload are left unchanged
+	*/
+	rawData := extractBody(w, r)
+	if rawData == nil {
+		return
+	}
+	newConfig := getServerConfig().clone()
+	if len(rawData) > 0 {
+		err := decodeJson(r, rawData, &newConfig)
+		if err != nil {
+			http.Error(w, invalidJsonMessage("config", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateSinks(newConfig.Sinks); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyForwardProxy(newConfig.ForwardProxy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setServerConfig(newConfig)
+	applyApiServerConfig(newConfig.Api)
+
+	jsonResponse, err := json.Marshal(newConfig)
+	if err != nil {
+		http.Error(w, "Failed to marshal config", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	tls "github.com/bogdanfinn/utls"
+)
+
+/*
+Pre-warms a session's connection to a host: DNS, TCP, TLS and HTTP/2 setup without sending a request,
+so the handshake is already paid for when the real request goes out.
+
+tls-client has no way to just dial, so a request carrying a header name that can't be sent is issued.
+The roundtripper opens and handshakes the connection to learn the protocol, and the HTTP/2 transport
+completes its preface, before either rejects the header. The connection stays cached for the next request.
+For an HTTP/1.1 origin the session already has a transport for, nothing is dialed: the transport's
+pooled connection, if any, is what the next request gets
+*/
+
+// connectProbeHeader is invalid on purpose, the request fails before anything is written to the connection
+const connectProbeHeader = "hrequests connect"
+
+const defaultConnectTimeout = 30 * time.Second
+
+type ConnectOutput struct {
+	SessionId string `json:"sessionId"`
+	// host:port connected to
+	Address   string `json:"address"`
+	Connected bool   `json:"connected"`
+	// negotiated protocol, only known for HTTP/2 connections
+	Alpn string `json:"alpn,omitempty"`
+	// an open HTTP/2 connection already existed
+	Reused     bool           `json:"reused"`
+	DurationMs int64          `json:"durationMs"`
+	Error      *ResponseError `json:"error,omitempty"`
+}
+
+func connectHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Opens the session's connection to requestUrl's host ahead of a request.
+		Takes the same input as /request, the method, headers and body are ignored
+	*/
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rawData := extractBody(w, r)
+	if rawData == nil {
+		return
+	}
+	input := ExtendedRequestInput{}
+	if err := decodeJson(r, rawData, &input); err != nil {
+		http.Error(w, invalidJsonMessage("connect", err), http.StatusBadRequest)
+		return
+	}
+	if _, withSession := inputSessionId(&input); !withSession {
+		http.Error(w, "Invalid JSON format for connect, sessionId is required to keep the connection", http.StatusBadRequest)
+		return
+	}
+	if peer, err := ownerPeer(&input); err != nil || peer != "" {
+		http.Error(w, "Session is owned by another bridge instance, connect through it instead", http.StatusBadRequest)
+		return
+	}
+	writeJson(w, connect(r.Context(), &input))
+}
+
+func connect(ctx context.Context, params *ExtendedRequestInput) *ConnectOutput {
+	sessionId, _ := inputSessionId(params)
+	output := &ConnectOutput{SessionId: sessionId}
+	start := time.Now()
+	fail := func(phase string, err error) *ConnectOutput {
+		code, phase := classifyError(phase, err)
+		output.Error = &ResponseError{Code: code, Message: err.Error(), Phase: phase}
+		output.DurationMs = time.Since(start).Milliseconds()
+		return output
+	}
+
+	target, err := parseConnectTarget(params.RequestUrl)
+	if err != nil {
+		return fail(phaseSetup, err)
+	}
+	output.Address = target.Host
+
+	if err := loadStoredSession(sessionId); err != nil {
+		return fail(phaseSetup, fmt.Errorf("failed to load session from store: %w", err))
+	}
+	release := getSession(sessionId).touch()
+	defer release()
+
+	clientInput, clientErr := buildClientInput(params)
+	if clientErr != nil {
+		return fail(phaseSetup, clientErr)
+	}
+	tlsClient, _, _, clientErr := tls_client_cffi.CreateClient(clientInput)
+	if clientErr != nil {
+		return fail(phaseSetup, clientErr)
+	}
+	getSession(sessionId).initClientInput(clientInput)
+	installClockJar(tlsClient)
+
+	timeout := defaultConnectTimeout
+	if params.TimeoutSeconds > 0 {
+		timeout = time.Duration(params.TimeoutSeconds) * time.Second
+	}
+	if params.TimeoutMilliseconds > 0 {
+		timeout = time.Duration(params.TimeoutMilliseconds) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		// only the HTTP/2 transport gets this far
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			output.Reused = info.Reused
+			if conn, ok := info.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+				output.Alpn = conn.ConnectionState().NegotiatedProtocol
+			}
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fail(phaseSetup, err)
+	}
+	req.Header[connectProbeHeader] = []string{"1"}
+
+	resp, err := tlsClient.Do(req)
+	if err == nil {
+		// can't happen unless the header got through, which still means we're connected
+		resp.Body.Close()
+	} else if !strings.Contains(err.Error(), fmt.Sprintf("%q", connectProbeHeader)) {
+		return fail(phaseConnect, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	output.Connected = true
+	output.DurationMs = time.Since(start).Milliseconds()
+	return output
+}
+
+// parseConnectTarget reduces a url to the origin connections are pooled by
+func parseConnectTarget(rawUrl string) (*url.URL, error) {
+	target, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if target.Hostname() == "" {
+		return nil, fmt.Errorf("invalid requestUrl: %s", rawUrl)
+	}
+	if !strings.EqualFold(target.Scheme, "https") {
+		return nil, errors.New("connect only supports https urls, plain http has no handshake to pre-warm")
+	}
+	port := target.Port()
+	if port == "" {
+		port = "443"
+	}
+	return &url.URL{Scheme: "https", Host: net.JoinHostPort(target.Hostname(), port), Path: "/"}, nil
+}
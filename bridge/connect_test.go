@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+func TestConnectPrewarm(t *testing.T) {
+	server := newOrigin(t, originHttp2Tls)
+	sessionId := testSessionId(t)
+	input := map[string]any{
+		"sessionId":           sessionId,
+		"requestUrl":          server.URL + "/echo",
+		"tlsClientIdentifier": "chrome_120",
+		"insecureSkipVerify":  true,
+	}
+	output := &ConnectOutput{}
+	if err := json.Unmarshal(bridgePost(t, "/connect", input), output); err != nil {
+		t.Fatal(err)
+	}
+	if !output.Connected || output.Alpn != "h2" {
+		t.Fatalf("connect returned %+v", output)
+	}
+	response := finalResponse(t, bridgeRequest(t, input))
+	if response.Connection == nil || !response.Connection.Reused {
+		t.Errorf("request after connect didn't reuse the connection: %+v", response.Connection)
+	}
+}
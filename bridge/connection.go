@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+)
+
+/*
+Details of the connection a response was received on
+*/
+
+type ConnectionInfo struct {
+	// address actually connected to. Through a proxy this is the proxy, except when the bridge's
+	// own dialer is in use (proxy chains, custom resolvers), where it is the next hop it dialed
+	RemoteIp   string `json:"remoteIp,omitempty"`
+	RemotePort int    `json:"remotePort,omitempty"`
+	// the connection was taken from the idle pool instead of being opened for this request
+	Reused       bool              `json:"reused"`
+	TlsVersion   string            `json:"tlsVersion,omitempty"`
+	CipherSuite  string            `json:"cipherSuite,omitempty"`
+	Alpn         string            `json:"alpn,omitempty"`
+	Certificates []CertificateInfo `json:"certificates,omitempty"`
+}
+
+// CertificateInfo describes one certificate of the chain the server presented, leaf first
+type CertificateInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	DnsNames  []string  `json:"dnsNames,omitempty"`
+}
+
+// connectionTrace records the connection a request was sent on
+type connectionTrace struct {
+	mu     sync.Mutex
+	remote string
+	reused bool
+}
+
+func (t *connectionTrace) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remote := ""
+			if info.Conn != nil {
+				remote = info.Conn.RemoteAddr().String()
+				// a connection to a dial shim stands in for the one the shim opened
+				if upstream, ok := shimUpstreamAddr(info.Conn.LocalAddr().String()); ok {
+					remote = upstream
+				}
+			}
+			t.mu.Lock()
+			t.remote, t.reused = remote, info.Reused
+			t.mu.Unlock()
+		},
+	})
+}
+
+func (t *connectionTrace) info(resp *http.Response) *ConnectionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.remote == "" && resp.TLS == nil {
+		return nil
+	}
+	info := &ConnectionInfo{Reused: t.reused}
+	if host, port, err := net.SplitHostPort(t.remote); err == nil {
+		info.RemoteIp = host
+		info.RemotePort, _ = strconv.Atoi(port)
+	}
+	if state := resp.TLS; state != nil {
+		info.TlsVersion = tlsVersionName(state.Version)
+		info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		info.Alpn = state.NegotiatedProtocol
+		for _, cert := range state.PeerCertificates {
+			info.Certificates = append(info.Certificates, CertificateInfo{
+				Subject:   cert.Subject.String(),
+				Issuer:    cert.Issuer.String(),
+				NotBefore: cert.NotBefore,
+				NotAfter:  cert.NotAfter,
+				DnsNames:  cert.DNSNames,
+			})
+		}
+	}
+	return info
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0:
+		return ""
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+var (
+	shimConnsLock sync.Mutex
+	// local address of a client connection to a dial shim mapped to the address the shim dialed for it
+	shimConns = make(map[string]string)
+)
+
+func setShimUpstream(clientAddr string, upstreamAddr string) {
+	shimConnsLock.Lock()
+	defer shimConnsLock.Unlock()
+	shimConns[clientAddr] = upstreamAddr
+}
+
+func removeShimUpstream(clientAddr string) {
+	shimConnsLock.Lock()
+	defer shimConnsLock.Unlock()
+	delete(shimConns, clientAddr)
+}
+
+func shimUpstreamAddr(clientAddr string) (string, bool) {
+	shimConnsLock.Lock()
+	defer shimConnsLock.Unlock()
+	addr, ok := shimConns[clientAddr]
+	return addr, ok
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+Per-request deadlines enforced with contexts, so a hung server can't pin a request forever.
+timeoutMs bounds the whole request including every redirect hop, readTimeoutMs the time spent
+waiting for the server without any data moving
+*/
+
+// RequestTimeoutError is returned when a request runs past its timeoutMs or readTimeoutMs
+type RequestTimeoutError struct {
+	// "timeoutMs" or "readTimeoutMs"
+	Limit     string
+	TimeoutMs int
+	Err       error
+}
+
+func (e *RequestTimeoutError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s of %dms exceeded", e.Limit, e.TimeoutMs)
+	}
+	return fmt.Sprintf("%s of %dms exceeded: %s", e.Limit, e.TimeoutMs, e.Err)
+}
+
+func (e *RequestTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RequestTimeoutError) Timeout() bool {
+	return true
+}
+
+func getTimeoutMs(requestInput *ExtendedRequestInput) int {
+	if requestInput.TimeoutMs > 0 {
+		return requestInput.TimeoutMs
+	}
+	return getServerConfig().TimeoutMs
+}
+
+func getReadTimeoutMs(requestInput *ExtendedRequestInput) int {
+	if requestInput.ReadTimeoutMs > 0 {
+		return requestInput.ReadTimeoutMs
+	}
+	return getServerConfig().ReadTimeoutMs
+}
+
+// requestContext bounds the whole request lifecycle, redirects included, by budgetMs and timeoutMs,
+// whichever ends first. The limit that ran out is the context's cause
+func requestContext(parent context.Context, params *ExtendedRequestInput) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	var cause error
+	now := time.Now()
+	if params.BudgetMs > 0 {
+		deadline = now.Add(time.Duration(params.BudgetMs) * time.Millisecond)
+		cause = &BudgetExceededError{BudgetMs: params.BudgetMs}
+	}
+	if timeoutMs := getTimeoutMs(params); timeoutMs > 0 {
+		if end := now.Add(time.Duration(timeoutMs) * time.Millisecond); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			cause = &RequestTimeoutError{Limit: "timeoutMs", TimeoutMs: timeoutMs}
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadlineCause(parent, deadline, cause)
+}
+
+// deadlineError explains failures caused by running out of budgetMs, timeoutMs or readTimeoutMs
+func deadlineError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	var budgetErr *BudgetExceededError
+	var timeoutErr *RequestTimeoutError
+	cause := context.Cause(ctx)
+	switch {
+	case errors.As(cause, &budgetErr):
+		return &BudgetExceededError{BudgetMs: budgetErr.BudgetMs, Err: err}
+	case errors.As(cause, &timeoutErr):
+		return &RequestTimeoutError{Limit: timeoutErr.Limit, TimeoutMs: timeoutErr.TimeoutMs, Err: err}
+	}
+	return err
+}
+
+// readWatchdog cancels a request once no data was sent or received for readTimeoutMs.
+// A nil watchdog does nothing
+type readWatchdog struct {
+	mu        sync.Mutex
+	timeoutMs int
+	cancel    context.CancelCauseFunc
+	timer     *time.Timer
+	stopped   bool
+}
+
+// newReadWatchdog returns the context to send the request with, the watchdog is armed by start
+func newReadWatchdog(parent context.Context, timeoutMs int) (context.Context, *readWatchdog) {
+	if timeoutMs <= 0 {
+		return parent, nil
+	}
+	ctx, cancel := context.WithCancelCause(parent)
+	return ctx, &readWatchdog{timeoutMs: timeoutMs, cancel: cancel}
+}
+
+func (w *readWatchdog) start() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer == nil && !w.stopped {
+		w.timer = time.AfterFunc(time.Duration(w.timeoutMs)*time.Millisecond, func() {
+			w.cancel(&RequestTimeoutError{Limit: "readTimeoutMs", TimeoutMs: w.timeoutMs})
+		})
+	}
+}
+
+// reset pushes the timeout back after data moved
+func (w *readWatchdog) reset() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil && !w.stopped {
+		w.timer.Reset(time.Duration(w.timeoutMs) * time.Millisecond)
+	}
+}
+
+// stop disarms the watchdog and releases its context once the response was read
+func (w *readWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.cancel(nil)
+}
+
+// watchBody resets the watchdog on every read from body
+func (w *readWatchdog) watchBody(body io.ReadCloser) io.ReadCloser {
+	if w == nil || body == nil {
+		return body
+	}
+	return &watchedBody{ReadCloser: body, watchdog: w}
+}
+
+type watchedBody struct {
+	io.ReadCloser
+	watchdog *readWatchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watchdog.reset()
+	}
+	return n, err
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+	"golang.org/x/net/proxy"
+)
+
+/*
+tls-client does not allow replacing its dialer, so connections that need custom
+dialing are routed through a local SOCKS5 shim that dials on its behalf
+*/
+
+// dialConfig describes how outgoing connections are established
+type dialConfig struct {
+	Resolver *ResolverConfig `json:"resolver,omitempty"`
+	// proxies traversed in order, ProxyUrl being the last hop
+	ProxyChain []string `json:"proxyChain,omitempty"`
+	ProxyUrl   string   `json:"proxyUrl,omitempty"`
+	// tunnel through the shim so 407 challenges can be answered
+	ProxyAuth bool         `json:"proxyAuth,omitempty"`
+	Local     *DialOptions `json:"local,omitempty"`
+	// record the response heads of plaintext connections, see headerlist.go
+	CaptureHeads bool `json:"captureHeads,omitempty"`
+}
+
+func (c dialConfig) proxies() []string {
+	if c.ProxyUrl == "" {
+		return c.ProxyChain
+	}
+	return append(append([]string{}, c.ProxyChain...), c.ProxyUrl)
+}
+
+// needsShim reports whether tls-client can't dial with this config on its own
+func (c dialConfig) needsShim() bool {
+	if c.Resolver != nil || len(c.ProxyChain) > 0 || c.ProxyAuth || c.CaptureHeads || !c.Local.isEmpty() {
+		return true
+	}
+	// tls-client dials socks5 itself, leaving resolution to the proxy, but doesn't know socks5h
+	if proxyUrl, err := url.Parse(c.ProxyUrl); err == nil {
+		return proxyUrl.Scheme == "socks5h"
+	}
+	return false
+}
+
+const (
+	dialTimeout = 30 * time.Second
+	// shims without open connections are closed once unused for this long
+	dialShimIdleTimeout = 10 * time.Minute
+	// beyond this many shims, the least recently used idle ones are closed
+	maxDialShims = 64
+	// configs of closed shims remembered for lookupDialShim
+	maxRetiredDialShims = 1024
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type dialShim struct {
+	config   dialConfig
+	listener net.Listener
+	username string
+	password string
+	dial     dialFunc
+	resolver *resolver
+
+	// connections being served and when the shim was last handed out or connected to
+	active   atomic.Int64
+	lastUsed atomic.Int64
+
+	// last dial failure per target, since SOCKS5 replies can't carry error details
+	errorsLock sync.Mutex
+	errors     map[string]error
+}
+
+var (
+	dialShimsLock sync.Mutex
+	dialShims     = make(map[string]*dialShim)
+	// url of closed shims mapped to their config, sessions may still be set to them
+	retiredDialShims     = make(map[string]dialConfig)
+	retiredDialShimOrder []string
+)
+
+// getDialShim returns the proxy url of a shim dialing with config, starting one if needed
+func getDialShim(config dialConfig) (string, error) {
+	rawKey, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	key := string(rawKey)
+
+	dialShimsLock.Lock()
+	defer dialShimsLock.Unlock()
+
+	shim, ok := dialShims[key]
+	if !ok {
+		evictDialShims()
+		shim, err = newDialShim(config)
+		if err != nil {
+			return "", err
+		}
+		dialShims[key] = shim
+	}
+	shim.touch()
+	return shim.url(), nil
+}
+
+// evictDialShims closes idle shims unused for dialShimIdleTimeout, then the least recently used
+// idle ones while there are maxDialShims or more. Must be called with dialShimsLock held.
+// Sessions set to a closed shim get a new one on their next request
+func evictDialShims() {
+	cutoff := time.Now().Add(-dialShimIdleTimeout).UnixNano()
+	var idle []string
+	for key, shim := range dialShims {
+		if shim.active.Load() > 0 {
+			continue
+		}
+		if shim.lastUsed.Load() < cutoff {
+			retireDialShim(key)
+			continue
+		}
+		idle = append(idle, key)
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return dialShims[idle[i]].lastUsed.Load() < dialShims[idle[j]].lastUsed.Load()
+	})
+	for _, key := range idle {
+		if len(dialShims) < maxDialShims {
+			break
+		}
+		retireDialShim(key)
+	}
+}
+
+// retireDialShim closes a shim, remembering its config. Must be called with dialShimsLock held
+func retireDialShim(key string) {
+	shim := dialShims[key]
+	delete(dialShims, key)
+	shim.Close()
+	url := shim.url()
+	if _, ok := retiredDialShims[url]; !ok {
+		retiredDialShimOrder = append(retiredDialShimOrder, url)
+	}
+	retiredDialShims[url] = shim.config
+	if len(retiredDialShimOrder) > maxRetiredDialShims {
+		delete(retiredDialShims, retiredDialShimOrder[0])
+		retiredDialShimOrder = retiredDialShimOrder[1:]
+	}
+}
+
+// closeDialShims closes every shim
+func closeDialShims() {
+	dialShimsLock.Lock()
+	defer dialShimsLock.Unlock()
+	for key := range dialShims {
+		retireDialShim(key)
+	}
+}
+
+func (s *dialShim) touch() {
+	s.lastUsed.Store(time.Now().UnixNano())
+}
+
+// Close stops accepting connections and releases the shim's resolver, open connections are served to the end
+func (s *dialShim) Close() error {
+	if s.resolver != nil {
+		removeResolver(s.resolver)
+	}
+	return s.listener.Close()
+}
+
+func newDialShim(config dialConfig) (*dialShim, error) {
+	shim := &dialShim{
+		config:   config,
+		username: randomHex(8),
+		password: randomHex(16),
+		errors:   make(map[string]error),
+	}
+	if config.Resolver != nil {
+		shim.resolver = newResolver(*config.Resolver)
+	}
+	dial, err := buildDialFunc(config, shim.resolver)
+	if err != nil {
+		if shim.resolver != nil {
+			removeResolver(shim.resolver)
+		}
+		return nil, err
+	}
+	shim.dial = dial
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if shim.resolver != nil {
+			removeResolver(shim.resolver)
+		}
+		return nil, fmt.Errorf("failed to start dial shim: %w", err)
+	}
+	shim.listener = listener
+	go shim.serve()
+	return shim, nil
+}
+
+// lookupDialShim returns the config of the shim listening at proxyUrl
+func lookupDialShim(proxyUrl string) (dialConfig, bool) {
+	dialShimsLock.Lock()
+	defer dialShimsLock.Unlock()
+	for _, shim := range dialShims {
+		if shim.url() == proxyUrl {
+			return shim.config, true
+		}
+	}
+	config, ok := retiredDialShims[proxyUrl]
+	return config, ok
+}
+
+func (s *dialShim) url() string {
+	return fmt.Sprintf("socks5://%s:%s@%s", s.username, s.password, s.listener.Addr().String())
+}
+
+func (s *dialShim) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves a single SOCKS5 CONNECT (RFC 1928) with username/password auth (RFC 1929)
+func (s *dialShim) handle(conn net.Conn) {
+	s.active.Add(1)
+	defer s.active.Add(-1)
+	s.touch()
+	defer s.touch()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// greeting
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	if !bytesContain(methods, 2) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// authentication
+	if !s.authenticate(reader) {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return
+		}
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	rawPort := make([]byte, 2)
+	if _, err := io.ReadFull(reader, rawPort); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(rawPort))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	upstream, err := s.dial(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		s.errorsLock.Lock()
+		s.errors[addr] = err
+		s.errorsLock.Unlock()
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	clientAddr := conn.RemoteAddr().String()
+	setShimUpstream(clientAddr, upstream.RemoteAddr().String())
+	defer removeShimUpstream(clientAddr)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	toUpstream, toClient := io.Reader(reader), io.Reader(upstream)
+	if s.config.CaptureHeads {
+		capture := startHeadCapture(clientAddr)
+		defer capture.stop(clientAddr)
+		toUpstream = io.TeeReader(reader, capture.requests)
+		toClient = io.TeeReader(upstream, capture.responses)
+	}
+
+	// pipe both directions until either side closes
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, toUpstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, toClient)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// takeError returns and forgets the last dial failure for addr
+func (s *dialShim) takeError(addr string) error {
+	s.errorsLock.Lock()
+	defer s.errorsLock.Unlock()
+	err := s.errors[addr]
+	delete(s.errors, addr)
+	return err
+}
+
+// shimDialError returns the reason the shim behind proxyUrl failed to reach target, if any
+func shimDialError(proxyUrl *string, target *url.URL) error {
+	if proxyUrl == nil || target == nil {
+		return nil
+	}
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(target.Hostname(), port)
+
+	dialShimsLock.Lock()
+	defer dialShimsLock.Unlock()
+	for _, shim := range dialShims {
+		if shim.url() == *proxyUrl {
+			return shim.takeError(addr)
+		}
+	}
+	return nil
+}
+
+func (s *dialShim) authenticate(reader *bufio.Reader) bool {
+	version, err := reader.ReadByte()
+	if err != nil || version != 1 {
+		return false
+	}
+	readField := func() (string, bool) {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return "", false
+		}
+		return string(field), true
+	}
+	username, ok := readField()
+	if !ok {
+		return false
+	}
+	password, ok := readField()
+	if !ok {
+		return false
+	}
+	return username == s.username && password == s.password
+}
+
+// buildDialFunc composes name resolution and the proxy hops into a single dial function
+func buildDialFunc(config dialConfig, res *resolver) (dialFunc, error) {
+	source, err := sourceDialFunc(config.Local)
+	if err != nil {
+		return nil, err
+	}
+	family := ""
+	if config.Local != nil {
+		family = config.Local.IpFamily
+	}
+
+	dial := resolvingDial(res, family, source)
+	for _, rawProxy := range config.proxies() {
+		proxyUrl, err := url.Parse(rawProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %w", rawProxy, err)
+		}
+		if proxyUrl.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q: missing host", rawProxy)
+		}
+		dial, err = proxyDialFunc(proxyUrl, dial, res, family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dial, nil
+}
+
+// resolvingDial resolves the target host with res before handing each address to dial
+func resolvingDial(res *resolver, family string, dial dialFunc) dialFunc {
+	if res == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := res.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if ips = filterFamily(ips, family); len(ips) == 0 {
+			return nil, fmt.Errorf("failed to resolve %s: no %s addresses found", host, family)
+		}
+		var lastErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+}
+
+func directDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	return d.DialContext(ctx, network, addr)
+}
+
+// proxyDialFunc returns a dial function tunneling through proxyUrl, reaching the proxy with forward.
+// The target is resolved by the proxy, like tls-client does for socks5, unless a custom resolver is set.
+// socks5h always hands the hostname over unresolved, even with a custom resolver
+func proxyDialFunc(proxyUrl *url.URL, forward dialFunc, res *resolver, family string) (dialFunc, error) {
+	switch proxyUrl.Scheme {
+	case "http", "https":
+		return resolvingDial(res, family, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialConnect(ctx, proxyUrl, forward, addr)
+		}), nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyUrl.User != nil {
+			password, _ := proxyUrl.User.Password()
+			auth = &proxy.Auth{User: proxyUrl.User.Username(), Password: password}
+		}
+		socksDialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, contextDialer(forward))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create socks5 proxy: %w", err)
+		}
+		dial := socksDialer.(proxy.ContextDialer).DialContext
+		if proxyUrl.Scheme == "socks5h" {
+			return dial, nil
+		}
+		return resolvingDial(res, family, dial), nil
+	default:
+		return nil, fmt.Errorf("proxy scheme %q is not supported", proxyUrl.Scheme)
+	}
+}
+
+// dialConnect opens a tunnel to addr through an HTTP(S) proxy using CONNECT.
+// Credentials from the proxy url are sent as Basic auth, answering a Digest challenge if the proxy asks for one
+func dialConnect(ctx context.Context, proxyUrl *url.URL, forward dialFunc, addr string) (net.Conn, error) {
+	var username, password string
+	if proxyUrl.User != nil {
+		username = proxyUrl.User.Username()
+		password, _ = proxyUrl.User.Password()
+	}
+
+	authorization := ""
+	scheme := ""
+	if username != "" {
+		authorization = basicAuthorization(username, password)
+		scheme = "Basic"
+	}
+	conn, resp, err := connectOnce(ctx, proxyUrl, forward, addr, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && username != "" {
+		if challenge, ok := findChallenge(resp.Header.Values("Proxy-Authenticate"), "Digest"); ok {
+			scheme = "Digest"
+			authorization, err = digestAuthorization(challenge, username, password, http.MethodConnect, addr)
+			if err != nil {
+				return nil, &ProxyAuthError{Scheme: scheme, Status: resp.Status, Err: err}
+			}
+			conn, resp, err = connectOnce(ctx, proxyUrl, forward, addr, authorization)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return conn, nil
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, &ProxyAuthError{Scheme: scheme, Status: resp.Status}
+	default:
+		return nil, fmt.Errorf("proxy responded with %s", resp.Status)
+	}
+}
+
+// connectOnce sends a single CONNECT request, returning the tunnel only when the proxy accepted it
+func connectOnce(ctx context.Context, proxyUrl *url.URL, forward dialFunc, addr string, authorization string) (net.Conn, *http.Response, error) {
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		if proxyUrl.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "80")
+		}
+	}
+	conn, err := forward(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proxyUrl.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if authorization != "" {
+		req += "Proxy-Authorization: " + authorization + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to read proxy response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, resp, nil
+	}
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, nil, errors.New("proxy sent unexpected data after CONNECT response")
+	}
+	return conn, resp, nil
+}
+
+// contextDialer adapts a dialFunc to the x/net/proxy dialer interfaces
+type contextDialer dialFunc
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func bytesContain(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// socksTargets accepts SOCKS5 connects without authentication and reports the target each one asked for,
+// as a hostname or IP, before closing the connection
+func socksTargets(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				io.ReadFull(conn, make([]byte, greeting[1]))
+				conn.Write([]byte{5, 0})
+
+				request := make([]byte, 4)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				var host string
+				switch request[3] {
+				case 1:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					length := make([]byte, 1)
+					io.ReadFull(conn, length)
+					name := make([]byte, length[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+				targets <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func TestSocks5hResolvesRemotely(t *testing.T) {
+	var lookups atomic.Int64
+	doh := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		lookups.Add(1)
+		stdhttp.Error(w, "no answers here", stdhttp.StatusServiceUnavailable)
+	}))
+	t.Cleanup(doh.Close)
+
+	tests := []struct {
+		scheme   string
+		resolver ResolverConfig
+		want     string
+	}{
+		// the custom resolver must never see the target
+		{"socks5h", ResolverConfig{DohUrl: doh.URL}, "target.test:80"},
+		// socks5 resolves the target with it
+		{"socks5", ResolverConfig{Hosts: map[string]string{"target.test": "127.0.0.9"}}, "127.0.0.9:80"},
+	}
+	for _, test := range tests {
+		t.Run(test.scheme, func(t *testing.T) {
+			address, targets := socksTargets(t)
+			res := newResolver(test.resolver)
+			t.Cleanup(func() { removeResolver(res) })
+			config := dialConfig{ProxyUrl: test.scheme + "://" + address, Resolver: &test.resolver}
+			dial, err := buildDialFunc(config, res)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial(context.Background(), "tcp", "target.test:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if target := <-targets; target != test.want {
+				t.Errorf("proxy asked for %s, want %s", target, test.want)
+			}
+		})
+	}
+	if n := lookups.Load(); n != 0 {
+		t.Errorf("resolver queried %d times for a socks5h target", n)
+	}
+}
+
+func TestDialShimEviction(t *testing.T) {
+	if (dialConfig{ProxyUrl: "socks5://127.0.0.1:1080"}).needsShim() {
+		t.Errorf("plain socks5 proxy routed through a dial shim")
+	}
+	if !(dialConfig{ProxyUrl: "socks5h://127.0.0.1:1080"}).needsShim() {
+		t.Errorf("socks5h proxy not routed through a dial shim")
+	}
+
+	t.Cleanup(closeDialShims)
+	var first string
+	for i := 0; i < maxDialShims+8; i++ {
+		shimUrl, err := getDialShim(dialConfig{ProxyUrl: "socks5h://127.0.0.1:" + strconv.Itoa(20000+i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = shimUrl
+		}
+	}
+	dialShimsLock.Lock()
+	open := len(dialShims)
+	dialShimsLock.Unlock()
+	if open > maxDialShims {
+		t.Errorf("%d dial shims open, want at most %d", open, maxDialShims)
+	}
+	// evicted shims still resolve to what they stood for
+	if config, ok := lookupDialShim(first); !ok || config.ProxyUrl != "socks5h://127.0.0.1:20000" {
+		t.Errorf("lookupDialShim(%s) = %v, %t", first, config, ok)
+	}
+}
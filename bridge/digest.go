@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Verifies response bodies against an expected digest, hashing them as they are read
+*/
+
+// DigestMismatchError is returned when a body doesn't match its expected digest
+type DigestMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+	// where the expected digest came from: "request" or the response header name
+	Source string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch: %s from %s expected %s, got %s", e.Algorithm, e.Source, e.Expected, e.Actual)
+}
+
+// supported algorithms, strongest first
+var digestAlgorithms = []struct {
+	name    string
+	aliases []string
+	new     func() hash.Hash
+}{
+	{"sha-512", []string{"sha-512", "sha512"}, sha512.New},
+	{"sha-256", []string{"sha-256", "sha256"}, sha256.New},
+	{"sha-1", []string{"sha-1", "sha1", "sha"}, sha1.New},
+	{"md5", []string{"md5"}, md5.New},
+}
+
+type digestCheck struct {
+	algorithm string
+	expected  []byte
+	source    string
+	hash      hash.Hash
+}
+
+func newDigestCheck(algorithm string, expected []byte, source string) *digestCheck {
+	algorithm = strings.ToLower(algorithm)
+	for _, candidate := range digestAlgorithms {
+		for _, alias := range candidate.aliases {
+			if alias == algorithm {
+				return &digestCheck{algorithm: candidate.name, expected: expected, source: source, hash: candidate.new()}
+			}
+		}
+	}
+	return nil
+}
+
+// parseExpectedDigest reads a caller-provided digest, either "algorithm=base64" or "algorithm:hex"
+func parseExpectedDigest(value string) (*digestCheck, error) {
+	var check *digestCheck
+	if algorithm, encoded, ok := strings.Cut(value, ":"); ok {
+		expected, err := hex.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex in expectedDigest: %w", err)
+		}
+		check = newDigestCheck(strings.TrimSpace(algorithm), expected, "request")
+	} else if algorithm, encoded, ok := strings.Cut(value, "="); ok {
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 in expectedDigest: %w", err)
+		}
+		check = newDigestCheck(strings.TrimSpace(algorithm), expected, "request")
+	} else {
+		return nil, fmt.Errorf("expectedDigest must be algorithm=base64 or algorithm:hex")
+	}
+	if check == nil {
+		return nil, fmt.Errorf("unsupported expectedDigest algorithm in %q", value)
+	}
+	return check, nil
+}
+
+// headerDigestCheck picks the strongest digest announced by Repr-Digest, Digest or Content-MD5
+func headerDigestCheck(header http.Header) *digestCheck {
+	var best *digestCheck
+	rank := func(check *digestCheck) int {
+		for i, candidate := range digestAlgorithms {
+			if candidate.name == check.algorithm {
+				return i
+			}
+		}
+		return len(digestAlgorithms)
+	}
+	consider := func(algorithm, encoded, source string) {
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return
+		}
+		if check := newDigestCheck(algorithm, expected, source); check != nil && (best == nil || rank(check) < rank(best)) {
+			best = check
+		}
+	}
+
+	// RFC 9530 structured fields, e.g. sha-256=:base64:
+	for _, member := range strings.Split(header.Get("Repr-Digest"), ",") {
+		if algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "="); ok {
+			consider(algorithm, strings.Trim(value, ":"), "Repr-Digest")
+		}
+	}
+	if best != nil {
+		return best
+	}
+	// RFC 3230, e.g. SHA-256=base64
+	for _, member := range strings.Split(header.Get("Digest"), ",") {
+		if algorithm, value, ok := strings.Cut(strings.TrimSpace(member), "="); ok {
+			consider(algorithm, value, "Digest")
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if value := header.Get("Content-MD5"); value != "" {
+		consider("md5", strings.TrimSpace(value), "Content-MD5")
+	}
+	return best
+}
+
+// hashBody feeds everything read from body into the check's hash
+func (c *digestCheck) hashBody(body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, c.hash), body}
+}
+
+// verify compares the hashed body against the expected digest
+func (c *digestCheck) verify() error {
+	actual := c.hash.Sum(nil)
+	if string(actual) == string(c.expected) {
+		return nil
+	}
+	return &DigestMismatchError{
+		Algorithm: c.algorithm,
+		Expected:  base64.StdEncoding.EncodeToString(c.expected),
+		Actual:    base64.StdEncoding.EncodeToString(actual),
+		Source:    c.source,
+	}
+}
+
+// digest formats the computed digest as "algorithm=base64"
+func (c *digestCheck) digest() string {
+	return c.algorithm + "=" + base64.StdEncoding.EncodeToString(c.hash.Sum(nil))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/tls-client/profiles"
+	tls "github.com/bogdanfinn/utls"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Environment diagnostics: outbound connectivity, proxies, DNS, clock skew and profile integrity
+*/
+
+const (
+	defaultDoctorTarget = "https://www.google.com/generate_204"
+	doctorCheckTimeout  = 15 * time.Second
+	// skew past which signed requests, cookie expiry and certificate validation start to misbehave
+	clockSkewWarning = 30 * time.Second
+	clockSkewFailure = 5 * time.Minute
+)
+
+const (
+	checkOk      = "ok"
+	checkWarn    = "warn"
+	checkFail    = "fail"
+	checkSkipped = "skipped"
+)
+
+type DoctorInput struct {
+	// url fetched to test connectivity, defaults to https://www.google.com/generate_204
+	TargetUrl           string          `json:"targetUrl"`
+	ProxyUrl            string          `json:"proxyUrl"`
+	ProxyChain          []string        `json:"proxyChain"`
+	Resolver            *ResolverConfig `json:"resolver"`
+	TLSClientIdentifier string          `json:"tlsClientIdentifier"`
+	// profiles to verify, every built-in profile when empty
+	Profiles []string `json:"profiles"`
+}
+
+type DoctorCheck struct {
+	Name string `json:"name"`
+	// "ok", "warn", "fail" or "skipped"
+	Status     string                 `json:"status"`
+	Message    string                 `json:"message,omitempty"`
+	DurationMs int64                  `json:"durationMs"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+type DoctorReport struct {
+	// false when any check failed
+	Ok         bool          `json:"ok"`
+	StartedAt  time.Time     `json:"startedAt"`
+	DurationMs int64         `json:"durationMs"`
+	Checks     []DoctorCheck `json:"checks"`
+}
+
+func doctorHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Runs the environment diagnostics and returns the report
+	*/
+	input := DoctorInput{}
+	if r.Method == http.MethodPost {
+		rawData := extractBody(w, r)
+		if len(rawData) > 0 {
+			if err := decodeJson(r, rawData, &input); err != nil {
+				http.Error(w, invalidJsonMessage("doctor", err), http.StatusBadRequest)
+				return
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, runDoctor(r.Context(), input))
+}
+
+// doctorCommand runs the diagnostics from the command line, taking an optional DoctorInput as JSON.
+// Prints the report and exits with status 1 when a check failed
+func doctorCommand(args []string) {
+	input := DoctorInput{}
+	if len(args) > 0 {
+		if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid JSON format for doctor: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	report := runDoctor(context.Background(), input)
+	encoded, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(encoded))
+	if !report.Ok {
+		os.Exit(1)
+	}
+}
+
+func runDoctor(ctx context.Context, input DoctorInput) DoctorReport {
+	if input.TargetUrl == "" {
+		input.TargetUrl = defaultDoctorTarget
+	}
+	report := DoctorReport{Ok: true, StartedAt: time.Now()}
+	add := func(check DoctorCheck) {
+		if check.Status == checkFail {
+			report.Ok = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	target, err := url.Parse(input.TargetUrl)
+	if err != nil || target.Hostname() == "" {
+		add(DoctorCheck{Name: "target", Status: checkFail, Message: fmt.Sprintf("invalid targetUrl: %s", input.TargetUrl)})
+	} else {
+		add(runCheck("dns", func(check *DoctorCheck) { checkDns(ctx, input, target, check) }))
+		var serverDate time.Time
+		add(runCheck("outbound", func(check *DoctorCheck) {
+			serverDate = checkFetch(ctx, input, false, check)
+		}))
+		if input.ProxyUrl != "" || len(input.ProxyChain) > 0 {
+			add(runCheck("proxyReachable", func(check *DoctorCheck) { checkProxyReachable(ctx, input, check) }))
+			add(runCheck("proxy", func(check *DoctorCheck) {
+				if proxyDate := checkFetch(ctx, input, true, check); serverDate.IsZero() {
+					serverDate = proxyDate
+				}
+			}))
+		} else {
+			add(DoctorCheck{Name: "proxy", Status: checkSkipped, Message: "no proxy configured"})
+		}
+		add(runCheck("clock", func(check *DoctorCheck) { checkClock(serverDate, check) }))
+	}
+	add(runCheck("profiles", func(check *DoctorCheck) { checkProfiles(input.Profiles, check) }))
+
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	return report
+}
+
+func runCheck(name string, run func(check *DoctorCheck)) DoctorCheck {
+	check := DoctorCheck{Name: name, Status: checkOk, Details: make(map[string]interface{})}
+	start := time.Now()
+	run(&check)
+	check.DurationMs = time.Since(start).Milliseconds()
+	return check
+}
+
+func (c *DoctorCheck) fail(format string, args ...interface{}) {
+	c.Status = checkFail
+	c.Message = fmt.Sprintf(format, args...)
+}
+
+func (c *DoctorCheck) warn(format string, args ...interface{}) {
+	if c.Status != checkFail {
+		c.Status = checkWarn
+		c.Message = fmt.Sprintf(format, args...)
+	}
+}
+
+func checkDns(ctx context.Context, input DoctorInput, target *url.URL, check *DoctorCheck) {
+	ctx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+	defer cancel()
+
+	config := input.Resolver
+	if config == nil {
+		config = getServerConfig().Resolver
+	}
+	var ips []net.IP
+	var err error
+	if config != nil {
+		check.Details["resolver"] = "custom"
+		ips, err = newResolver(*config).lookup(ctx, target.Hostname())
+	} else {
+		check.Details["resolver"] = "system"
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", target.Hostname())
+	}
+	check.Details["host"] = target.Hostname()
+	if err != nil {
+		check.fail("failed to resolve %s: %v", target.Hostname(), err)
+		return
+	}
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = ip.String()
+	}
+	check.Details["addresses"] = addresses
+}
+
+// checkFetch requests the target directly or through the configured proxy, returning the server's Date
+func checkFetch(ctx context.Context, input DoctorInput, viaProxy bool, check *DoctorCheck) time.Time {
+	ctx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+	defer cancel()
+
+	params := &ExtendedRequestInput{Resolver: input.Resolver}
+	params.RequestUrl = input.TargetUrl
+	params.RequestMethod = http.MethodGet
+	params.TLSClientIdentifier = input.TLSClientIdentifier
+	params.FollowRedirects = true
+	params.TimeoutSeconds = int(doctorCheckTimeout / time.Second)
+	if viaProxy {
+		if input.ProxyUrl != "" {
+			params.ProxyUrl = &input.ProxyUrl
+		}
+		params.ProxyChain = input.ProxyChain
+	}
+
+	response := request(ctx, params)
+	if response.Status == 0 {
+		check.fail("%s", response.Body)
+		if response.Error != nil {
+			check.Details["code"] = response.Error.Code
+			check.Details["phase"] = response.Error.Phase
+		}
+		return time.Time{}
+	}
+	check.Details["status"] = response.Status
+	check.Details["protocol"] = response.UsedProtocol
+	if connection := response.Connection; connection != nil {
+		check.Details["remoteIp"] = connection.RemoteIp
+		if connection.TlsVersion != "" {
+			check.Details["tlsVersion"] = connection.TlsVersion
+		}
+	}
+	if response.Status >= 500 || response.Status == http.StatusProxyAuthRequired {
+		check.warn("target answered with status %d", response.Status)
+	}
+
+	for name, values := range response.Headers {
+		if http.CanonicalHeaderKey(name) == "Date" && len(values) > 0 {
+			if date, err := http.ParseTime(values[0]); err == nil {
+				return date
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func checkProxyReachable(ctx context.Context, input DoctorInput, check *DoctorCheck) {
+	proxies := append(append([]string{}, input.ProxyChain...), input.ProxyUrl)
+	if input.ProxyUrl == "" {
+		proxies = proxies[:len(proxies)-1]
+	}
+	// only the first hop is reachable from here, later hops are tested by the proxied request
+	proxyUrl, err := url.Parse(proxies[0])
+	if err != nil || proxyUrl.Host == "" {
+		check.fail("invalid proxy url: %s", proxies[0])
+		return
+	}
+	addr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		port := "80"
+		switch proxyUrl.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		}
+		addr = net.JoinHostPort(proxyUrl.Hostname(), port)
+	}
+	check.Details["address"] = addr
+
+	dialer := net.Dialer{Timeout: doctorCheckTimeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		check.fail("failed to connect to proxy %s: %v", addr, err)
+		return
+	}
+	conn.Close()
+	check.Details["connectMs"] = time.Since(start).Milliseconds()
+}
+
+func checkClock(serverDate time.Time, check *DoctorCheck) {
+	if serverDate.IsZero() {
+		check.Status = checkSkipped
+		check.Message = "no Date header received from the target"
+		return
+	}
+	// Date has a resolution of one second
+	skew := time.Since(serverDate).Truncate(time.Second)
+	check.Details["skewSeconds"] = skew.Seconds()
+	check.Details["serverTime"] = serverDate.UTC()
+	abs := time.Duration(math.Abs(float64(skew)))
+	if abs > clockSkewFailure {
+		check.fail("local clock is off by %s", skew)
+	} else if abs > clockSkewWarning {
+		check.warn("local clock is off by %s", skew)
+	}
+}
+
+// checkProfiles builds a ClientHello for every profile without connecting anywhere
+func checkProfiles(names []string, check *DoctorCheck) {
+	if len(names) == 0 {
+		for name := range profiles.MappedTLSClients {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var broken []string
+	errors := make(map[string]string)
+	for _, name := range names {
+		profile, ok := profiles.MappedTLSClients[name]
+		if !ok {
+			broken = append(broken, name)
+			errors[name] = "unknown profile"
+			continue
+		}
+		if err := buildClientHello(profile); err != nil {
+			broken = append(broken, name)
+			errors[name] = err.Error()
+		}
+	}
+	check.Details["checked"] = len(names)
+	if len(broken) > 0 {
+		check.Details["errors"] = errors
+		check.fail("%d of %d profiles failed to build a ClientHello", len(broken), len(names))
+	}
+}
+
+func buildClientHello(profile profiles.ClientProfile) (err error) {
+	defer func() {
+		// presets are hand written, a broken one may panic instead of failing
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	uconn := tls.UClient(client, &tls.Config{ServerName: "example.com"}, profile.GetClientHelloId(), false, false)
+	return uconn.BuildHandshakeState()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	"github.com/google/uuid"
+)
+
+/*
+Machine-readable classification of request failures
+*/
+
+// phases a request can fail in
+const (
+	phaseSetup     = "setup"
+	phaseRateLimit = "rateLimit"
+	phaseConnect   = "connect"
+	phaseTls       = "tls"
+	phaseRequest   = "request"
+	phaseResponse  = "response"
+	phaseForward   = "forward"
+)
+
+type ResponseError struct {
+	// e.g. "timeout", "dns", "tls_handshake", "proxy", "too_many_redirects"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// where the request failed: setup, rateLimit, connect, tls, request, response or forward
+	Phase string `json:"phase"`
+}
+
+// BudgetExceededError is returned when a request runs out of its budgetMs
+type BudgetExceededError struct {
+	BudgetMs int
+	Err      error
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("request budget of %dms exceeded", e.BudgetMs)
+	}
+	return fmt.Sprintf("request budget of %dms exceeded: %s", e.BudgetMs, e.Err)
+}
+
+func (e *BudgetExceededError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError maps a failure to an error code, refining the phase it happened in where the error tells
+func classifyError(phase string, err error) (string, string) {
+	var budgetErr *BudgetExceededError
+	var timeoutErr *RequestTimeoutError
+	var proxyAuthErr *ProxyAuthError
+	var tooLargeErr *ResponseTooLargeError
+	var digestErr *DigestMismatchError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case errors.As(err, &budgetErr):
+		return "budget_exceeded", phase
+	case errors.As(err, &timeoutErr):
+		return "timeout", phase
+	case errors.As(err, &tooLargeErr):
+		return "response_too_large", phase
+	case errors.As(err, &digestErr):
+		return "digest_mismatch", phase
+	case errors.As(err, &proxyAuthErr), isProxyAuthFailure(err):
+		return "proxy_auth", phaseConnect
+	case errors.Is(err, context.Canceled):
+		return "canceled", phase
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(), strings.Contains(message, "timeout"):
+		return "timeout", phase
+	case errors.As(err, &dnsErr), strings.Contains(message, "failed to resolve"), strings.Contains(message, "no such host"):
+		return "dns", phaseConnect
+	case strings.Contains(message, "rate limit"):
+		return "rate_limited", phase
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &certificateErr), errors.As(err, &hostnameErr), strings.Contains(message, "x509"):
+		return "tls_certificate", phaseTls
+	case strings.Contains(message, "tls:"), strings.Contains(message, "handshake"):
+		return "tls_handshake", phaseTls
+	case strings.Contains(message, "proxy"), strings.Contains(message, "socks"):
+		return "proxy", phaseConnect
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(message, "connection refused"):
+		return "connection_refused", phaseConnect
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF),
+		strings.Contains(message, "connection reset"), strings.Contains(message, "broken pipe"):
+		return "connection_reset", phase
+	case strings.Contains(message, "stopped after"):
+		return "too_many_redirects", phase
+	}
+
+	switch phase {
+	case phaseSetup:
+		return "invalid_request", phase
+	case phaseForward:
+		return "forward_failed", phase
+	}
+	return "unknown", phase
+}
+
+// handleErrorResponse builds the response sent back for a failed request.
+// The message stays in Body for callers that predate the error object
+func handleErrorResponse(sessionId string, withSession bool, phase string, err error) *Response {
+	code, phase := classifyError(phase, err)
+	response := Response{
+		Response: tls_client_cffi.Response{
+			Id:      uuid.New().String(),
+			Status:  0,
+			Body:    err.Error(),
+			Headers: nil,
+			Cookies: nil,
+		},
+		Error: &ResponseError{Code: code, Message: err.Error(), Phase: phase},
+	}
+
+	if withSession {
+		response.SessionId = sessionId
+	}
+
+	return &response
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/bogdanfinn/fhttp/http2"
+	tls_client "github.com/bogdanfinn/tls-client"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+/*
+Custom TLS and HTTP/2 fingerprints built per request, with unspecified values taken from a preset profile
+*/
+
+type FingerprintInput struct {
+	// preset the HTTP/2 values not given below are copied from, defaults to the request's tlsClientIdentifier
+	BaseProfile string `json:"baseProfile"`
+	// raw JA3 string of the ClientHello, required
+	Ja3 string `json:"ja3"`
+	// SETTINGS frame values by name, e.g. {"HEADER_TABLE_SIZE": 65536}
+	H2Settings        map[string]uint32                `json:"h2Settings"`
+	H2SettingsOrder   []string                         `json:"h2SettingsOrder"`
+	PseudoHeaderOrder []string                         `json:"pseudoHeaderOrder"`
+	PriorityFrames    []tls_client_cffi.PriorityFrames `json:"priorityFrames"`
+	HeaderPriority    *tls_client_cffi.PriorityParam   `json:"headerPriority"`
+	// WINDOW_UPDATE increment sent after the SETTINGS frame
+	ConnectionFlow uint32 `json:"connectionFlow"`
+
+	SupportedSignatureAlgorithms            []string `json:"supportedSignatureAlgorithms"`
+	SupportedDelegatedCredentialsAlgorithms []string `json:"supportedDelegatedCredentialsAlgorithms"`
+	SupportedVersions                       []string `json:"supportedVersions"`
+	KeyShareCurves                          []string `json:"keyShareCurves"`
+	CertCompressionAlgo                     string   `json:"certCompressionAlgo"`
+}
+
+var (
+	defaultSignatureAlgorithms = []string{
+		"ECDSAWithP256AndSHA256",
+		"PSSWithSHA256",
+		"PKCS1WithSHA256",
+		"ECDSAWithP384AndSHA384",
+		"PSSWithSHA384",
+		"PKCS1WithSHA384",
+		"PSSWithSHA512",
+		"PKCS1WithSHA512",
+	}
+	defaultSupportedVersions = []string{"GREASE", "1.3", "1.2"}
+	defaultKeyShareCurves    = []string{"GREASE", "X25519"}
+)
+
+// buildCustomTlsClient turns a fingerprint into a tls-client custom profile
+func buildCustomTlsClient(fingerprint *FingerprintInput, identifier string) (*tls_client_cffi.CustomTlsClient, error) {
+	if fingerprint.Ja3 == "" {
+		return nil, fmt.Errorf("fingerprint requires a ja3 string")
+	}
+	baseName := fingerprint.BaseProfile
+	if baseName == "" {
+		baseName = identifier
+	}
+	base, ok := profiles.MappedTLSClients[baseName]
+	if !ok {
+		if fingerprint.BaseProfile != "" {
+			return nil, fmt.Errorf("unknown fingerprint baseProfile %s", fingerprint.BaseProfile)
+		}
+		base = profiles.DefaultClientProfile
+	}
+
+	custom := &tls_client_cffi.CustomTlsClient{
+		Ja3String:                               fingerprint.Ja3,
+		H2Settings:                              fingerprint.H2Settings,
+		H2SettingsOrder:                         fingerprint.H2SettingsOrder,
+		PseudoHeaderOrder:                       fingerprint.PseudoHeaderOrder,
+		PriorityFrames:                          fingerprint.PriorityFrames,
+		HeaderPriority:                          fingerprint.HeaderPriority,
+		ConnectionFlow:                          fingerprint.ConnectionFlow,
+		SupportedSignatureAlgorithms:            fingerprint.SupportedSignatureAlgorithms,
+		SupportedDelegatedCredentialsAlgorithms: fingerprint.SupportedDelegatedCredentialsAlgorithms,
+		SupportedVersions:                       fingerprint.SupportedVersions,
+		KeyShareCurves:                          fingerprint.KeyShareCurves,
+		CertCompressionAlgo:                     fingerprint.CertCompressionAlgo,
+	}
+
+	settingNames := make(map[http2.SettingID]string, len(tls_client.H2SettingsMap))
+	for name, id := range tls_client.H2SettingsMap {
+		settingNames[id] = name
+	}
+	if custom.H2Settings == nil {
+		custom.H2Settings = make(map[string]uint32)
+		for id, value := range base.GetSettings() {
+			if name, ok := settingNames[id]; ok {
+				custom.H2Settings[name] = value
+			}
+		}
+	}
+	if custom.H2SettingsOrder == nil {
+		for _, id := range base.GetSettingsOrder() {
+			if name, ok := settingNames[id]; ok {
+				custom.H2SettingsOrder = append(custom.H2SettingsOrder, name)
+			}
+		}
+	}
+	if custom.PseudoHeaderOrder == nil {
+		custom.PseudoHeaderOrder = base.GetPseudoHeaderOrder()
+	}
+	if custom.PriorityFrames == nil {
+		for _, priority := range base.GetPriorities() {
+			custom.PriorityFrames = append(custom.PriorityFrames, tls_client_cffi.PriorityFrames{
+				StreamID: priority.StreamID,
+				PriorityParam: tls_client_cffi.PriorityParam{
+					StreamDep: priority.PriorityParam.StreamDep,
+					Exclusive: priority.PriorityParam.Exclusive,
+					Weight:    priority.PriorityParam.Weight,
+				},
+			})
+		}
+	}
+	if custom.HeaderPriority == nil {
+		if priority := base.GetHeaderPriority(); priority != nil {
+			custom.HeaderPriority = &tls_client_cffi.PriorityParam{
+				StreamDep: priority.StreamDep,
+				Exclusive: priority.Exclusive,
+				Weight:    priority.Weight,
+			}
+		}
+	}
+	if custom.ConnectionFlow == 0 {
+		custom.ConnectionFlow = base.GetConnectionFlow()
+	}
+	if custom.SupportedSignatureAlgorithms == nil {
+		custom.SupportedSignatureAlgorithms = defaultSignatureAlgorithms
+	}
+	if custom.SupportedVersions == nil {
+		custom.SupportedVersions = defaultSupportedVersions
+	}
+	if custom.KeyShareCurves == nil {
+		custom.KeyShareCurves = defaultKeyShareCurves
+	}
+	if custom.CertCompressionAlgo == "" {
+		// needed whenever the JA3 lists the compress_certificate extension
+		custom.CertCompressionAlgo = "brotli"
+	}
+	return custom, nil
+}
+
+// applyFingerprint swaps the client profile of input for the request's custom fingerprint
+func applyFingerprint(requestInput *ExtendedRequestInput, input *tls_client_cffi.RequestInput) *tls_client_cffi.TLSClientError {
+	if requestInput.Fingerprint == nil {
+		return nil
+	}
+	custom, err := buildCustomTlsClient(requestInput.Fingerprint, input.TLSClientIdentifier)
+	if err != nil {
+		return tls_client_cffi.NewTLSClientError(err)
+	}
+	input.CustomTlsClient = custom
+	input.TLSClientIdentifier = ""
+	return nil
+}
+
+// refreshSessionFingerprint rebuilds an existing session client when the request asks for a different fingerprint
+func refreshSessionFingerprint(sessionId string, clientInput tls_client_cffi.RequestInput) error {
+	recorded, ok := getSession(sessionId).getClientInput()
+	if !ok || reflect.DeepEqual(recorded.CustomTlsClient, clientInput.CustomTlsClient) {
+		return nil
+	}
+	if _, err := tls_client_cffi.GetClient(sessionId); err != nil {
+		// not built yet, CreateClient will use the new fingerprint
+		return nil
+	}
+	return rebuildSessionClient(sessionId, func(input *tls_client_cffi.RequestInput) {
+		input.CustomTlsClient = clientInput.CustomTlsClient
+		input.TLSClientIdentifier = ""
+	})
+}
@@ -0,0 +1,539 @@
+//go:build !no_forwardproxy
+
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	"github.com/google/uuid"
+)
+
+/*
+Local forward proxy sending traffic through tls-client, so browsers and other tools get the same
+fingerprint, cookie jar and upstream proxy as the JSON API.
+CONNECT tunnels are intercepted with certificates signed by the proxy's CA, which the client has to trust.
+The client side of intercepted tunnels only speaks HTTP/1.1, and protocol upgrades such as websockets are not supported
+*/
+
+func init() {
+	registerCapability("forwardProxy", true)
+}
+
+type ForwardProxyConfig struct {
+	// address to listen on, e.g. "127.0.0.1:8899"
+	Listen string `json:"listen"`
+	// client options applied to every proxied request, e.g. tlsClientIdentifier, proxyUrl and sessionId.
+	// A session is created for the proxy when no sessionId is given
+	Template ExtendedRequestInput `json:"template"`
+	// PEM files holding the CA that signs intercepted hosts. Generated, and written there if set, when missing
+	CaCertFile string `json:"caCertFile"`
+	CaKeyFile  string `json:"caKeyFile"`
+	// require Basic Proxy-Authorization with the bridge auth token as password (default true),
+	// false lets anyone reaching the listen address use the proxy
+	RequireAuth *bool `json:"requireAuth"`
+}
+
+func (c *ForwardProxyConfig) requireAuth() bool {
+	return c.RequireAuth == nil || *c.RequireAuth
+}
+
+type ForwardProxyOutput struct {
+	Running   bool   `json:"running"`
+	Address   string `json:"address,omitempty"`
+	SessionId string `json:"sessionId,omitempty"`
+	// PEM certificate of the CA to trust in the client
+	CaCert string `json:"caCert,omitempty"`
+}
+
+// hop-by-hop headers, which are never forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type forwardProxy struct {
+	config    ForwardProxyConfig
+	sessionId string
+	listener  net.Listener
+	server    *http.Server
+	ca        *x509.Certificate
+	caKey     crypto.Signer
+	caPem     []byte
+
+	certsLock sync.Mutex
+	certs     map[string]*stdtls.Certificate
+}
+
+var (
+	forwardProxyLock sync.Mutex
+	activeProxy      *forwardProxy
+)
+
+// applyForwardProxy starts, restarts or stops the forward proxy to match config
+func applyForwardProxy(config *ForwardProxyConfig) error {
+	forwardProxyLock.Lock()
+	defer forwardProxyLock.Unlock()
+
+	if activeProxy != nil && config != nil && reflect.DeepEqual(activeProxy.config, *config) {
+		return nil
+	}
+	if config == nil || config.Listen == "" {
+		if activeProxy != nil {
+			activeProxy.close()
+			activeProxy = nil
+		}
+		return nil
+	}
+
+	proxy, err := newForwardProxy(*config)
+	if err != nil {
+		return err
+	}
+	// the running proxy keeps serving until the new one is listening
+	err = proxy.start()
+	if err != nil && activeProxy != nil && activeProxy.config.Listen == config.Listen {
+		// the running proxy holds the address, release it and take over
+		activeProxy.close()
+		if err = proxy.start(); err != nil && activeProxy.start() != nil {
+			activeProxy = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start forward proxy: %w", err)
+	}
+	if activeProxy != nil {
+		activeProxy.close()
+	}
+	activeProxy = proxy
+	return nil
+}
+
+func newForwardProxy(config ForwardProxyConfig) (*forwardProxy, error) {
+	proxy := &forwardProxy{config: config, certs: make(map[string]*stdtls.Certificate)}
+	if config.Template.SessionId != nil && *config.Template.SessionId != "" {
+		proxy.sessionId = *config.Template.SessionId
+	} else {
+		proxy.sessionId = "forward-proxy-" + uuid.New().String()
+	}
+	if err := proxy.loadCa(); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// start binds the configured address and serves on it
+func (p *forwardProxy) start() error {
+	listener, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	p.server = &http.Server{Handler: p}
+	go p.server.Serve(listener)
+	return nil
+}
+
+func (p *forwardProxy) close() {
+	p.server.Close()
+	p.listener.Close()
+}
+
+func forwardProxyHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Returns the address, session and CA certificate of the running forward proxy
+	*/
+	output := ForwardProxyOutput{}
+	// the listener is replaced when a proxy is restarted, read it under the lock
+	forwardProxyLock.Lock()
+	if proxy := activeProxy; proxy != nil {
+		output = ForwardProxyOutput{
+			Running:   true,
+			Address:   proxy.listener.Addr().String(),
+			SessionId: proxy.sessionId,
+			CaCert:    string(proxy.caPem),
+		}
+	}
+	forwardProxyLock.Unlock()
+	writeJson(w, output)
+}
+
+func (p *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.config.requireAuth() && !validProxyAuth(r.Header.Get("Proxy-Authorization")) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="hrequests"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a forward proxy, requests need an absolute url", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Upgrade") != "" {
+		http.Error(w, "Protocol upgrades are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	resp, err := p.roundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func validProxyAuth(header string) bool {
+	token := authToken.Load()
+	if token == nil {
+		return true
+	}
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	_, password, _ := strings.Cut(string(decoded), ":")
+	return subtle.ConstantTimeCompare([]byte(password), []byte(*token)) == 1
+}
+
+func (p *forwardProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be taken over", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	target := r.URL.Host
+	if target == "" {
+		target = r.Host
+	}
+	client := &bufferedConn{Conn: conn, reader: buffered.Reader}
+	// tunnels carry plain HTTP too, TLS records start with a handshake byte
+	first, err := client.reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != 0x16 {
+		p.serveTunnel(client, "http", target)
+		return
+	}
+
+	tlsConn := stdtls.Server(client, &stdtls.Config{
+		GetCertificate: func(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host, _, _ = net.SplitHostPort(target)
+			}
+			return p.certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return
+	}
+	defer tlsConn.Close()
+	p.serveTunnel(tlsConn, "https", target)
+}
+
+// serveTunnel forwards the requests read from an intercepted tunnel until either side closes it
+func (p *forwardProxy) serveTunnel(conn net.Conn, scheme string, target string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return
+	}
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		target = host
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = scheme
+		req.URL.Host = target
+
+		var resp *http.Response
+		if req.Header.Get("Upgrade") != "" {
+			resp = proxyErrorResponse(req, http.StatusNotImplemented, errors.New("protocol upgrades are not supported"))
+		} else if resp, err = p.roundTrip(req); err != nil {
+			resp = proxyErrorResponse(req, http.StatusBadGateway, err)
+		}
+		removeHopHeaders(resp.Header)
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		if resp.ContentLength < 0 {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		resp.Close = req.Close
+		writeErr := resp.Write(conn)
+		resp.Body.Close()
+		// the next request can only be read once this one's body is consumed
+		io.Copy(io.Discard, req.Body)
+		if writeErr != nil || req.Close {
+			return
+		}
+	}
+}
+
+// roundTrip sends a request received by the proxy through the tls-client of the proxy session
+func (p *forwardProxy) roundTrip(req *http.Request) (*http.Response, error) {
+	params := p.config.Template
+	params.SessionId = &p.sessionId
+	params.RequestUrl = req.URL.String()
+	params.RequestMethod = req.Method
+	// redirects are left to the client
+	params.FollowRedirects = false
+
+	clientInput, clientErr := buildClientInput(&params)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	tlsClient, sessionId, withSession, clientErr := tls_client_cffi.CreateClient(clientInput)
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	session := getSession(sessionId)
+	session.initClientInput(clientInput)
+	installClockJar(tlsClient)
+
+	ctx, cancelContext := requestContext(req.Context(), &params)
+	release := session.touch()
+	cancel := func() {
+		cancelContext()
+		release()
+	}
+	outReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	outReq.Header = req.Header.Clone()
+	removeHopHeaders(outReq.Header)
+	for name, value := range params.Headers {
+		if outReq.Header.Get(name) == "" {
+			outReq.Header.Set(name, value)
+		}
+	}
+	outReq.ContentLength = req.ContentLength
+
+	if err := getLimiter(&params, sessionId, withSession).wait(ctx, outReq.URL.Hostname()); err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := tlsClient.Do(outReq)
+	if err != nil {
+		cancel()
+		if shimErr := shimDialError(clientInput.ProxyUrl, outReq.URL); shimErr != nil {
+			err = shimErr
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func proxyErrorResponse(req *http.Request, status int, err error) *http.Response {
+	body := err.Error()
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	// headers named by Connection are hop-by-hop as well
+	for _, field := range header.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// certificate returns a certificate for host signed by the proxy CA
+func (p *forwardProxy) certificate(host string) (*stdtls.Certificate, error) {
+	p.certsLock.Lock()
+	defer p.certsLock.Unlock()
+	if cert, ok := p.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &stdtls.Certificate{Certificate: [][]byte{der, p.ca.Raw}, PrivateKey: key, Leaf: leaf}
+	p.certs[host] = cert
+	return cert, nil
+}
+
+// loadCa reads the CA from the configured files, generating it when they are missing
+func (p *forwardProxy) loadCa() error {
+	if p.config.CaCertFile != "" && p.config.CaKeyFile != "" {
+		pair, err := stdtls.LoadX509KeyPair(p.config.CaCertFile, p.config.CaKeyFile)
+		if err == nil {
+			ca, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("invalid forward proxy CA: %w", err)
+			}
+			signer, ok := pair.PrivateKey.(crypto.Signer)
+			if !ok {
+				return fmt.Errorf("invalid forward proxy CA: unsupported key type")
+			}
+			p.ca, p.caKey = ca, signer
+			p.caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to load forward proxy CA: %w", err)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "hrequests bridge forward proxy CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	p.ca, p.caKey = ca, key
+	p.caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if p.config.CaCertFile != "" && p.config.CaKeyFile != "" {
+		rawKey, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(p.config.CaKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0o600); err != nil {
+			return fmt.Errorf("failed to save forward proxy CA: %w", err)
+		}
+		if err := os.WriteFile(p.config.CaCertFile, p.caPem, 0o644); err != nil {
+			return fmt.Errorf("failed to save forward proxy CA: %w", err)
+		}
+	}
+	return nil
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
+
+// bufferedConn reads through the reader holding bytes already buffered from the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// cancelOnClose releases the request context and session once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	once   sync.Once
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.cancel)
+	return err
+}
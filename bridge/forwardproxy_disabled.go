@@ -0,0 +1,26 @@
+//go:build no_forwardproxy
+
+package main
+
+import (
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+func init() {
+	registerCapability("forwardProxy", false)
+}
+
+// ForwardProxyConfig is kept opaque so configs written for a full build still parse
+type ForwardProxyConfig = json.RawMessage
+
+func applyForwardProxy(config *ForwardProxyConfig) error {
+	if config != nil {
+		return &CapabilityMissingError{Name: "forwardProxy"}
+	}
+	return nil
+}
+
+func forwardProxyHandler(w http.ResponseWriter, r *http.Request) {
+	capabilityMissing(w, "forwardProxy")
+}
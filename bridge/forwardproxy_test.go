@@ -0,0 +1,73 @@
+//go:build !no_forwardproxy
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+	fhttptest "github.com/bogdanfinn/fhttp/httptest"
+)
+
+func TestForwardProxyRequiresAuth(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		config ForwardProxyConfig
+		status int
+	}{
+		{ForwardProxyConfig{}, http.StatusProxyAuthRequired},
+		// an origin-form request only gets past authentication to be rejected
+		{ForwardProxyConfig{RequireAuth: &disabled}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := fhttptest.NewRecorder()
+		proxy := &forwardProxy{config: test.config}
+		proxy.ServeHTTP(recorder, fhttptest.NewRequest(http.MethodGet, "/", nil))
+		if recorder.Code != test.status {
+			t.Errorf("requireAuth %v: status %d, want %d", test.config.RequireAuth, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestForwardProxyKeepsRunningWhenRestartFails(t *testing.T) {
+	t.Cleanup(func() { applyForwardProxy(nil) })
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.Addr().String()
+	free.Close()
+
+	if err := applyForwardProxy(&ForwardProxyConfig{Listen: address}); err != nil {
+		t.Fatal(err)
+	}
+	running := activeProxy
+
+	// a new address that can't be bound leaves the running proxy alone
+	if err := applyForwardProxy(&ForwardProxyConfig{Listen: busy.Addr().String()}); err == nil {
+		t.Fatal("listening on a busy address succeeded")
+	}
+	if activeProxy != running {
+		t.Fatal("failed restart replaced the running proxy")
+	}
+	if conn, err := net.Dial("tcp", address); err != nil {
+		t.Errorf("running proxy stopped accepting: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// a new config on the same address takes it over
+	disabled := false
+	if err := applyForwardProxy(&ForwardProxyConfig{Listen: address, RequireAuth: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if activeProxy == running || activeProxy.listener.Addr().String() != address {
+		t.Errorf("proxy not restarted on %s", address)
+	}
+}
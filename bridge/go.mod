@@ -3,19 +3,19 @@ module hrequests_bridge
 go 1.21.1
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/bogdanfinn/fhttp v0.5.24
 	github.com/bogdanfinn/tls-client v1.6.1
+	github.com/bogdanfinn/utls v1.5.16
 	github.com/goccy/go-json v0.10.2
 	github.com/google/uuid v1.3.1
+	github.com/klauspost/compress v1.15.12
+	golang.org/x/net v0.7.0
+	golang.org/x/text v0.7.0
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
-	github.com/bogdanfinn/utls v1.5.16 // indirect
-	github.com/klauspost/compress v1.15.12 // indirect
 	github.com/tam7t/hpkp v0.0.0-20160821193359-2b70b4024ed5 // indirect
 	golang.org/x/crypto v0.1.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
-	golang.org/x/text v0.7.0 // indirect
 )
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Records bridge traffic per session in HAR 1.2 format
+*/
+
+const (
+	defaultHarMaxBodyBytes = 64 * 1024
+	maxHarEntries          = 10000
+)
+
+type HarLog struct {
+	Log HarLogBody `json:"log"`
+}
+
+type HarLogBody struct {
+	Version string     `json:"version"`
+	Creator HarCreator `json:"creator"`
+	Entries []HarEntry `json:"entries"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+	// set when the request failed before a response was received
+	Error string `json:"_error,omitempty"`
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HarContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HarTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harRecorder struct {
+	mu      sync.Mutex
+	enabled bool
+	entries []HarEntry
+}
+
+// sessionless requests asking for recording share one recorder
+var sessionlessHar = &harRecorder{}
+
+// getHarRecorder returns the recorder of a request, applying its recordHar toggle, or nil if it isn't recording
+func getHarRecorder(requestInput *ExtendedRequestInput, sessionId string, withSession bool) *harRecorder {
+	if requestInput.isMirror {
+		return nil
+	}
+	recorder := sessionlessHar
+	if withSession {
+		recorder = getSession(sessionId).getHar()
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if requestInput.RecordHar != nil {
+		recorder.enabled = *requestInput.RecordHar
+	}
+	if !recorder.enabled {
+		return nil
+	}
+	return recorder
+}
+
+func (h *harRecorder) add(entry HarEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= maxHarEntries {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, entry)
+}
+
+func (h *harRecorder) export() HarLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]HarEntry, len(h.entries))
+	copy(entries, h.entries)
+	return HarLog{Log: HarLogBody{
+		Version: "1.2",
+		Creator: HarCreator{Name: "hrequests-bridge", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+func (h *harRecorder) clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = nil
+}
+
+func getHarMaxBodyBytes() int {
+	if limit := getServerConfig().HarMaxBodyBytes; limit > 0 {
+		return limit
+	}
+	return defaultHarMaxBodyBytes
+}
+
+// harTimer tracks the phases of a recorded request
+type harTimer struct {
+	start   time.Time
+	headers time.Time
+	// start according to the bridge clock, which the phases aren't measured with
+	startedAt time.Time
+}
+
+func newHarEntry(req *http.Request, requestInput *ExtendedRequestInput, timer harTimer) HarEntry {
+	end := time.Now()
+	if timer.headers.IsZero() {
+		timer.headers = end
+	}
+	entry := HarEntry{
+		StartedDateTime: timer.startedAt.UTC().Format(time.RFC3339Nano),
+		Time:            milliseconds(end.Sub(timer.start)),
+		Request: HarRequest{
+			Method:      req.Method,
+			Url:         req.URL.String(),
+			HttpVersion: "HTTP/1.1",
+			Cookies:     []HarNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harHeaders(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: HarResponse{
+			Cookies:     []HarNameValue{},
+			Headers:     []HarNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: HarTimings{
+			Send:    0,
+			Wait:    milliseconds(timer.headers.Sub(timer.start)),
+			Receive: milliseconds(end.Sub(timer.headers)),
+		},
+	}
+	for _, cookie := range req.Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, HarNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	if body := requestInput.RequestBody; body != nil && *body != "" {
+		entry.Request.BodySize = len(*body)
+		entry.Request.PostData = &HarPostData{MimeType: req.Header.Get("Content-Type")}
+		entry.Request.PostData.Text, entry.Request.PostData.Comment = capHarText(*body)
+	}
+	return entry
+}
+
+// setResponse fills in the response part of entry from what is sent back to the client
+func (entry *HarEntry) setResponse(resp *http.Response, response *Response) {
+	entry.Request.HttpVersion = resp.Proto
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode)))
+	entry.Response.HttpVersion = resp.Proto
+	entry.Response.Headers = harHeaders(response.Headers)
+	entry.Response.RedirectURL = resp.Header.Get("Location")
+	for name, value := range response.Cookies {
+		entry.Response.Cookies = append(entry.Response.Cookies, HarNameValue{Name: name, Value: value})
+	}
+
+	content := HarContent{MimeType: resp.Header.Get("Content-Type"), Size: len(response.Body)}
+	text := response.Body
+	if strings.HasPrefix(text, "data:") {
+		// byte responses are already base64 encoded
+		if _, encoded, ok := strings.Cut(text, ";base64,"); ok {
+			text, content.Encoding = encoded, "base64"
+			content.Size = len(encoded) * 3 / 4
+		}
+	}
+	content.Text, content.Comment = capHarText(text)
+	entry.Response.Content = content
+	entry.Response.BodySize = content.Size
+}
+
+func capHarText(text string) (string, string) {
+	if limit := getHarMaxBodyBytes(); len(text) > limit {
+		return text[:limit], fmt.Sprintf("truncated to %d bytes", limit)
+	}
+	return text, ""
+}
+
+func harHeaders(headers map[string][]string) []HarNameValue {
+	values := []HarNameValue{}
+	for name, headerValues := range headers {
+		for _, value := range headerValues {
+			values = append(values, HarNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harRecorderFromQuery looks up the recorder named by the sessionId query parameter
+func harRecorderFromQuery(r *http.Request) *harRecorder {
+	sessionId := r.URL.Query().Get("sessionId")
+	if sessionId == "" {
+		return sessionlessHar
+	}
+	return getSession(sessionId).getHar()
+}
+
+func harExportHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Returns the traffic recorded for ?sessionId= as a HAR 1.2 log
+	*/
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, harRecorderFromQuery(r).export())
+}
+
+func harClearHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Drops the traffic recorded for ?sessionId=, recording stays enabled
+	*/
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	harRecorderFromQuery(r).clear()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	json "github.com/goccy/go-json"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Integration test harness: a bridge listening on a random port, driven over its HTTP API like the
+Python client does, against local origins with scripted behaviors
+*/
+
+// bridgeUrl is the base url of the bridge started by TestMain
+var bridgeUrl string
+
+const harnessToken = "integration-test-token"
+
+func TestMain(m *testing.M) {
+	listener, err := listen("0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start bridge: %v\n", err)
+		os.Exit(1)
+	}
+	setAuthToken(harnessToken)
+	bridgeUrl = fmt.Sprintf("http://127.0.0.1:%d", listener.Addr().(*net.TCPAddr).Port)
+	go serveApi(startApiServer(listener))
+
+	code := m.Run()
+	stopServer(0)
+	os.Exit(code)
+}
+
+// origin protocols
+const (
+	originHttp1    = "http/1.1"
+	originHttp1Tls = "http/1.1+tls"
+	originHttp2Tls = "h2"
+)
+
+var originProtocols = []struct {
+	protocol string
+	// UsedProtocol reported by the bridge
+	used string
+}{
+	{originHttp1, "HTTP/1.1"},
+	{originHttp1Tls, "HTTP/1.1"},
+	{originHttp2Tls, "HTTP/2.0"},
+}
+
+// newOrigin starts an origin speaking protocol with the scripted routes below
+func newOrigin(t *testing.T, protocol string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(originRoutes())
+	switch protocol {
+	case originHttp1:
+		server.Start()
+	case originHttp1Tls:
+		server.StartTLS()
+	case originHttp2Tls:
+		server.EnableHTTP2 = true
+		server.StartTLS()
+	default:
+		t.Fatalf("unknown origin protocol %s", protocol)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// originRoutes scripts the behaviors exercised by the integration tests:
+//
+//	/echo                 method, protocol, headers, cookies and decompressed body of the request as JSON
+//	/redirect/{n}         redirects n times before landing on /echo, with ?status= picking the code
+//	/set-cookie/{n}/{v}   sets cookie n=v, with ?redirect= redirecting afterwards
+//	/slow?chunks=&delay=  writes chunks one byte at a time, delay ms apart
+//	/stall                sends headers and a few bytes, then nothing
+//	/raw-header           sends a header value that isn't valid UTF-8
+//	/compressed/{enc}     "hello compressed" encoded with gzip, deflate or br
+//	/header-case          headers with lower case names and repeated values
+//	/file?size=           size bytes of rangeFileByte, answering Range requests
+func originRoutes() stdhttp.Handler {
+	mux := stdhttp.NewServeMux()
+	mux.HandleFunc("/echo", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		cookies := map[string]string{}
+		for _, cookie := range r.Cookies() {
+			cookies[cookie.Name] = cookie.Value
+		}
+		var reader io.Reader = r.Body
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			reader, _ = gzip.NewReader(r.Body)
+		case "br":
+			reader = brotli.NewReader(r.Body)
+		case "zstd":
+			decoder, _ := zstd.NewReader(r.Body)
+			defer decoder.Close()
+			reader = decoder
+		}
+		body, _ := io.ReadAll(reader)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"method":  r.Method,
+			"proto":   r.Proto,
+			"path":    r.URL.RequestURI(),
+			"headers": r.Header,
+			"cookies": cookies,
+			"body":    string(body),
+		})
+	})
+	mux.HandleFunc("/redirect/", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if err != nil {
+			stdhttp.Error(w, "bad count", stdhttp.StatusBadRequest)
+			return
+		}
+		status := stdhttp.StatusFound
+		if value := r.URL.Query().Get("status"); value != "" {
+			status, _ = strconv.Atoi(value)
+		}
+		next := "/echo"
+		if n > 1 {
+			next = fmt.Sprintf("/redirect/%d?%s", n-1, r.URL.RawQuery)
+		}
+		stdhttp.Redirect(w, r, next, status)
+	})
+	mux.HandleFunc("/set-cookie/", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		name, value, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/set-cookie/"), "/")
+		stdhttp.SetCookie(w, &stdhttp.Cookie{Name: name, Value: value, Path: "/"})
+		if target := r.URL.Query().Get("redirect"); target != "" {
+			stdhttp.Redirect(w, r, target, stdhttp.StatusFound)
+			return
+		}
+		w.Write([]byte("set"))
+	})
+	mux.HandleFunc("/slow", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		chunks, _ := strconv.Atoi(r.URL.Query().Get("chunks"))
+		delay, _ := strconv.Atoi(r.URL.Query().Get("delay"))
+		for i := 0; i < chunks; i++ {
+			w.Write([]byte("x"))
+			w.(stdhttp.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(delay) * time.Millisecond):
+			}
+		}
+	})
+	mux.HandleFunc("/stall", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		w.Write([]byte("partial"))
+		w.(stdhttp.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/raw-header", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		w.Header()["X-Latin1"] = []string{"caf\xe9"}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/compressed/", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		encoding := strings.TrimPrefix(r.URL.Path, "/compressed/")
+		var buf bytes.Buffer
+		var encoder io.WriteCloser
+		switch encoding {
+		case "gzip":
+			encoder = gzip.NewWriter(&buf)
+		case "deflate":
+			encoder = zlib.NewWriter(&buf)
+		case "br":
+			encoder = brotli.NewWriter(&buf)
+		default:
+			stdhttp.Error(w, "unknown encoding", stdhttp.StatusBadRequest)
+			return
+		}
+		encoder.Write([]byte("hello compressed"))
+		encoder.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/header-case", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		// set directly, the server writes names as given
+		w.Header()["x-lower"] = []string{"1"}
+		w.Header()["Set-Cookie"] = []string{"b=2", "a=1"}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/file", func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = rangeFileByte(i)
+		}
+		w.Header().Set("ETag", `"file-`+strconv.Itoa(size)+`"`)
+		stdhttp.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	})
+	return mux
+}
+
+// rangeFileByte is the byte at offset i of /file, varying enough to catch misplaced segments
+func rangeFileByte(i int) byte {
+	return byte(i % 251)
+}
+
+// bridgePost sends payload to a bridge endpoint, failing the test unless it answers 200
+func bridgePost(t *testing.T, path string, payload any) []byte {
+	t.Helper()
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := stdhttp.NewRequest(stdhttp.MethodPost, bridgeUrl+path, bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(authTokenHeader, harnessToken)
+	resp, err := stdhttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("bridge %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != stdhttp.StatusOK {
+		t.Fatalf("bridge %s answered %d: %s", path, resp.StatusCode, body)
+	}
+	return body
+}
+
+// bridgeDo sends a bodyless request to a bridge endpoint, returning the response whatever its status
+func bridgeDo(t *testing.T, method string, path string) (*stdhttp.Response, []byte) {
+	t.Helper()
+	req, err := stdhttp.NewRequest(method, bridgeUrl+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(authTokenHeader, harnessToken)
+	resp, err := stdhttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("bridge %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// bridgeRequest runs input through /request the way the Python client does
+func bridgeRequest(t *testing.T, input map[string]any) *ResponseWrapper {
+	t.Helper()
+	payload := map[string]any{
+		"requestMethod":       "GET",
+		"tlsClientIdentifier": "chrome_120",
+		"followRedirects":     true,
+		"insecureSkipVerify":  true,
+		"timeoutSeconds":      10,
+	}
+	for key, value := range input {
+		payload[key] = value
+	}
+	wrapper := &ResponseWrapper{}
+	if err := json.Unmarshal(bridgePost(t, "/request", payload), wrapper); err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+// finalResponse returns the last response of a wrapper, failing the test if the request failed
+func finalResponse(t *testing.T, wrapper *ResponseWrapper) *Response {
+	t.Helper()
+	response := wrapper.Response
+	if wrapper.IsHistory {
+		if len(wrapper.History) == 0 {
+			t.Fatal("empty history")
+		}
+		response = wrapper.History[len(wrapper.History)-1]
+	}
+	if response == nil {
+		t.Fatal("no response")
+	}
+	if response.Status == 0 {
+		t.Fatalf("request failed: %s", response.Body)
+	}
+	return response
+}
+
+// echoed decodes the body of a response from /echo
+func echoed(t *testing.T, response *Response) map[string]any {
+	t.Helper()
+	echo := map[string]any{}
+	if err := json.Unmarshal([]byte(response.Body), &echo); err != nil {
+		t.Fatalf("invalid echo body %q: %v", response.Body, err)
+	}
+	return echo
+}
+
+// testSessionId returns a session id unique to the test, destroyed when it ends
+func testSessionId(t *testing.T) string {
+	sessionId := "test-" + strings.ReplaceAll(t.Name(), "/", "-")
+	t.Cleanup(func() { DestroySession(sessionId) })
+	return sessionId
+}
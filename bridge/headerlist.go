@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/fhttp/httptrace"
+)
+
+/*
+Response headers as an ordered list of [name, value] pairs. fhttp hands responses over as a
+canonicalized map, so the order and casing of header names are gone by the time the bridge sees
+them. For plain http targets the dial shim sees the response as sent and records its head. TLS
+hides the head from the shim, so https responses, and any head that couldn't be matched to the
+response, are flagged as unavailable rather than given an order made up from the map
+*/
+
+// headerListUnavailable is the headerListSource of responses whose wire order wasn't observed
+const headerListUnavailable = "unavailable"
+
+const (
+	// heads kept per connection, a redirect chain reusing it only needs the last one
+	maxCapturedHeads = 8
+	// how long the heads of a closed connection can still be taken
+	capturedHeadRetention = 30 * time.Second
+)
+
+type capturedHead struct {
+	status int
+	pairs  [][2]string
+}
+
+// headCapture records the response heads passing through one dial shim connection
+type headCapture struct {
+	mu    sync.Mutex
+	heads []capturedHead
+	// methods of the requests sent on the connection, a response to HEAD has no body
+	methods   chan string
+	requests  *feedParser
+	responses *feedParser
+}
+
+var (
+	headCapturesLock sync.Mutex
+	// local address of a client connection to a dial shim mapped to the heads received on it
+	headCaptures = make(map[string]*headCapture)
+)
+
+// startHeadCapture records the heads of the connection from clientAddr. The returned capture is fed
+// the bytes sent in both directions and must be stopped once the connection is closed
+func startHeadCapture(clientAddr string) *headCapture {
+	capture := &headCapture{methods: make(chan string, maxCapturedHeads)}
+	capture.requests = newFeedParser(capture.parseRequests)
+	capture.responses = newFeedParser(capture.parseResponses)
+	headCapturesLock.Lock()
+	headCaptures[clientAddr] = capture
+	headCapturesLock.Unlock()
+	return capture
+}
+
+// stop ends parsing, the heads stay available for capturedHeadRetention
+func (c *headCapture) stop(clientAddr string) {
+	c.requests.close()
+	c.responses.close()
+	time.AfterFunc(capturedHeadRetention, func() {
+		headCapturesLock.Lock()
+		defer headCapturesLock.Unlock()
+		if headCaptures[clientAddr] == c {
+			delete(headCaptures, clientAddr)
+		}
+	})
+}
+
+// takeCapturedHead returns the pairs of the last head received on the connection from clientAddr,
+// if it has the given status. The connection's heads are forgotten either way
+func takeCapturedHead(clientAddr string, status int) ([][2]string, bool) {
+	headCapturesLock.Lock()
+	capture := headCaptures[clientAddr]
+	headCapturesLock.Unlock()
+	if capture == nil {
+		return nil, false
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if len(capture.heads) == 0 {
+		return nil, false
+	}
+	last := capture.heads[len(capture.heads)-1]
+	capture.heads = nil
+	if last.status != status {
+		return nil, false
+	}
+	return last.pairs, true
+}
+
+func (c *headCapture) record(status int, pairs [][2]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heads = append(c.heads, capturedHead{status: status, pairs: pairs})
+	if len(c.heads) > maxCapturedHeads {
+		c.heads = c.heads[len(c.heads)-maxCapturedHeads:]
+	}
+}
+
+func (c *headCapture) parseRequests(r *bufio.Reader) {
+	reader := textproto.NewReader(r)
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		method, _, _ := strings.Cut(line, " ")
+		pairs, err := readHeadPairs(reader)
+		if err != nil {
+			return
+		}
+		select {
+		case c.methods <- method:
+		default:
+		}
+		chunked, length := bodyFraming(pairs)
+		if !skipBody(r, reader, chunked, max(length, 0)) {
+			return
+		}
+	}
+}
+
+func (c *headCapture) parseResponses(r *bufio.Reader) {
+	reader := textproto.NewReader(r)
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		_, rest, _ := strings.Cut(line, " ")
+		code, _, _ := strings.Cut(rest, " ")
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return
+		}
+		pairs, err := readHeadPairs(reader)
+		if err != nil {
+			return
+		}
+		if status == http.StatusSwitchingProtocols {
+			return
+		}
+		if status < 200 {
+			// interim responses precede the final one to the same request
+			continue
+		}
+		method := http.MethodGet
+		select {
+		case method = <-c.methods:
+		default:
+		}
+		c.record(status, pairs)
+
+		chunked, length := bodyFraming(pairs)
+		if method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+			chunked, length = false, 0
+		}
+		if !skipBody(r, reader, chunked, length) {
+			return
+		}
+	}
+}
+
+// readHeadPairs reads header lines up to the blank line ending a head, keeping names as sent
+func readHeadPairs(reader *textproto.Reader) ([][2]string, error) {
+	var pairs [][2]string
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return pairs, nil
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		pairs = append(pairs, [2]string{name, strings.TrimSpace(value)})
+	}
+}
+
+// bodyFraming returns whether the body is chunked, or its Content-Length, -1 when it runs to the end of the connection
+func bodyFraming(pairs [][2]string) (bool, int64) {
+	length := int64(-1)
+	for _, pair := range pairs {
+		switch {
+		case strings.EqualFold(pair[0], "Transfer-Encoding") && strings.Contains(strings.ToLower(pair[1]), "chunked"):
+			return true, 0
+		case strings.EqualFold(pair[0], "Content-Length"):
+			if n, err := strconv.ParseInt(pair[1], 10, 64); err == nil {
+				length = n
+			}
+		}
+	}
+	return false, length
+}
+
+// skipBody reads past a body, returning false when the connection can't carry another message
+func skipBody(r *bufio.Reader, reader *textproto.Reader, chunked bool, length int64) bool {
+	switch {
+	case chunked:
+		if _, err := io.Copy(io.Discard, httputil.NewChunkedReader(r)); err != nil {
+			return false
+		}
+		// trailers, ended by a blank line
+		_, err := readHeadPairs(reader)
+		return err == nil
+	case length >= 0:
+		_, err := io.CopyN(io.Discard, r, length)
+		return err == nil
+	default:
+		io.Copy(io.Discard, r)
+		return false
+	}
+}
+
+// feedParser runs a parser in its own goroutine over everything written to it. Write only returns once
+// the parser used up the written bytes and waits for more, so whatever they completed is recorded
+// before the bytes are passed on
+type feedParser struct {
+	in   chan []byte
+	idle chan struct{}
+	// closed when the parser returned
+	done chan struct{}
+	// closed when the connection was
+	closed  chan struct{}
+	pending []byte
+	// a writer waits for pending to be used up
+	owed bool
+}
+
+func newFeedParser(parse func(*bufio.Reader)) *feedParser {
+	p := &feedParser{
+		in:     make(chan []byte),
+		idle:   make(chan struct{}),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		parse(bufio.NewReader(p))
+	}()
+	return p
+}
+
+func (p *feedParser) Write(b []byte) (int, error) {
+	select {
+	case p.in <- b:
+	case <-p.done:
+		return len(b), nil
+	case <-p.closed:
+		return len(b), nil
+	}
+	select {
+	case <-p.idle:
+	case <-p.done:
+	}
+	return len(b), nil
+}
+
+func (p *feedParser) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if p.owed {
+			p.owed = false
+			p.idle <- struct{}{}
+		}
+		select {
+		case chunk := <-p.in:
+			p.pending, p.owed = chunk, true
+		case <-p.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *feedParser) close() {
+	close(p.closed)
+}
+
+// capturesHeads reports whether the response heads of a request can be read by the dial shim,
+// which only holds for plaintext targets
+func capturesHeads(requestInput *ExtendedRequestInput) bool {
+	return requestInput.OrderedHeaders && strings.HasPrefix(strings.ToLower(requestInput.RequestUrl), "http://")
+}
+
+// traceLocalAddr returns req reporting the local address of the connection it is sent on,
+// which is how the heads a dial shim captured are found again
+func traceLocalAddr(req *http.Request) (*http.Request, func() string) {
+	var mu sync.Mutex
+	local := ""
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil {
+				return
+			}
+			mu.Lock()
+			local = info.Conn.LocalAddr().String()
+			mu.Unlock()
+		},
+	})
+	return req.WithContext(ctx), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return local
+	}
+}
+
+// buildHeaderList returns the headers of response as [name, value] pairs in the order and casing of the
+// head captured on the connection from clientAddr, with "wire" as their source. Without such a head
+// there is no list and the source is headerListUnavailable
+func buildHeaderList(response *Response, clientAddr string) ([][2]string, string) {
+	pairs, ok := takeCapturedHead(clientAddr, response.Status)
+	if !ok {
+		return nil, headerListUnavailable
+	}
+	list := make([][2]string, len(pairs))
+	for i, pair := range pairs {
+		list[i] = [2]string{pair[0], encodeHeaderValue(pair[1], response.EncodedHeaders[http.CanonicalHeaderKey(pair[0])])}
+	}
+	return list, "wire"
+}
+
+// encodeHeaderValue converts a raw value the way sanitizeHeaders did for its header
+func encodeHeaderValue(value string, encoding string) string {
+	switch encoding {
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	case "latin1":
+		return latin1ToUtf8(value)
+	}
+	return value
+}
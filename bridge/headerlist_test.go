@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrderedHeaders(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	// twice, the second response arrives on a reused connection
+	for i := 0; i < 2; i++ {
+		response := finalResponse(t, bridgeRequest(t, map[string]any{
+			"sessionId":      testSessionId(t),
+			"requestUrl":     server.URL + "/header-case",
+			"orderedHeaders": true,
+		}))
+		if response.HeaderListSource != "wire" {
+			t.Errorf("headerListSource %q, want wire", response.HeaderListSource)
+		}
+		var names, cookies []string
+		for _, pair := range response.HeaderList {
+			names = append(names, pair[0])
+			if pair[0] == "Set-Cookie" {
+				cookies = append(cookies, pair[1])
+			}
+		}
+		if !slices.Contains(names, "x-lower") {
+			t.Errorf("headerList names %v, want x-lower", names)
+		}
+		if !slices.Equal(cookies, []string{"b=2", "a=1"}) {
+			t.Errorf("Set-Cookie values %v, want them in the order sent", cookies)
+		}
+	}
+
+	// TLS hides the head, no order is made up for it
+	for _, protocol := range []string{originHttp1Tls, originHttp2Tls} {
+		t.Run(protocol, func(t *testing.T) {
+			server := newOrigin(t, protocol)
+			response := finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/header-case", "orderedHeaders": true}))
+			if response.HeaderListSource != headerListUnavailable || response.HeaderList != nil {
+				t.Errorf("headerList %v from %q, want none and unavailable", response.HeaderList, response.HeaderListSource)
+			}
+		})
+	}
+
+	// without the flag nothing changes
+	response := finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/header-case"}))
+	if response.HeaderList != nil || response.HeaderListSource != "" {
+		t.Errorf("headerList %v from %q without orderedHeaders", response.HeaderList, response.HeaderListSource)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+func TestProtocols(t *testing.T) {
+	for _, origin := range originProtocols {
+		t.Run(origin.protocol, func(t *testing.T) {
+			server := newOrigin(t, origin.protocol)
+			response := finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/echo"}))
+			if response.Status != 200 {
+				t.Fatalf("status %d", response.Status)
+			}
+			if response.UsedProtocol != origin.used {
+				t.Errorf("usedProtocol %s, want %s", response.UsedProtocol, origin.used)
+			}
+			if proto := echoed(t, response)["proto"]; proto != origin.used {
+				t.Errorf("origin saw %v, want %s", proto, origin.used)
+			}
+		})
+	}
+}
+
+func TestRedirectChain(t *testing.T) {
+	for _, origin := range originProtocols {
+		t.Run(origin.protocol, func(t *testing.T) {
+			server := newOrigin(t, origin.protocol)
+
+			response := finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/redirect/3"}))
+			if response.Status != 200 || response.Target != server.URL+"/echo" {
+				t.Fatalf("followed to %d %s, want 200 %s/echo", response.Status, response.Target, server.URL)
+			}
+
+			wrapper := bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/redirect/3", "wantHistory": true})
+			if !wrapper.IsHistory || len(wrapper.History) != 4 {
+				t.Fatalf("history of %d responses, want 4", len(wrapper.History))
+			}
+			for i, hop := range wrapper.History[:3] {
+				if hop.Status != 302 {
+					t.Errorf("hop %d status %d, want 302", i, hop.Status)
+				}
+			}
+
+			response = finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/redirect/2", "followRedirects": false}))
+			if response.Status != 302 {
+				t.Errorf("status %d without following redirects, want 302", response.Status)
+			}
+		})
+	}
+}
+
+func TestRedirectMethod(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	tests := []struct {
+		status string
+		method string
+		body   string
+	}{
+		// 301, 302 and 303 turn a POST into a bodyless GET, 307 and 308 replay it
+		{"302", "GET", ""},
+		{"303", "GET", ""},
+		{"307", "POST", "payload"},
+		{"308", "POST", "payload"},
+	}
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			response := finalResponse(t, bridgeRequest(t, map[string]any{
+				"requestUrl":    server.URL + "/redirect/1?status=" + test.status,
+				"requestMethod": "POST",
+				"requestBody":   "payload",
+			}))
+			echo := echoed(t, response)
+			if echo["method"] != test.method || echo["body"] != test.body {
+				t.Errorf("redirected as %v with body %q, want %s with %q", echo["method"], echo["body"], test.method, test.body)
+			}
+		})
+	}
+}
+
+func TestSessionCookies(t *testing.T) {
+	for _, origin := range originProtocols {
+		t.Run(origin.protocol, func(t *testing.T) {
+			server := newOrigin(t, origin.protocol)
+			sessionId := testSessionId(t)
+
+			// a cookie set on a redirect hop is sent on the following hop
+			response := finalResponse(t, bridgeRequest(t, map[string]any{
+				"sessionId":  sessionId,
+				"requestUrl": server.URL + "/set-cookie/hop/1?redirect=/echo",
+			}))
+			if cookies := echoed(t, response)["cookies"].(map[string]any); cookies["hop"] != "1" {
+				t.Errorf("redirect target got cookies %v, want hop=1", cookies)
+			}
+
+			// and kept by the session for later requests
+			response = finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/echo"}))
+			if cookies := echoed(t, response)["cookies"].(map[string]any); cookies["hop"] != "1" {
+				t.Errorf("later request got cookies %v, want hop=1", cookies)
+			}
+			if response.JarCookies["hop"] != "1" {
+				t.Errorf("jarCookies %v, want hop=1", response.JarCookies)
+			}
+			if len(response.ResponseCookies) != 0 {
+				t.Errorf("responseCookies %v for a response setting none", response.ResponseCookies)
+			}
+		})
+	}
+}
+
+func TestSessionlessCookiesAreNotKept(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/set-cookie/temp/1"}))
+	response := finalResponse(t, bridgeRequest(t, map[string]any{"requestUrl": server.URL + "/echo"}))
+	if cookies := echoed(t, response)["cookies"].(map[string]any); len(cookies) != 0 {
+		t.Errorf("sessionless request got cookies %v", cookies)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "br"} {
+		for _, origin := range originProtocols {
+			t.Run(encoding+"/"+origin.protocol, func(t *testing.T) {
+				if encoding == "deflate" && origin.protocol == originHttp2Tls {
+					// fhttp's HTTP/2 transport decompresses in its read loop, and sniffing a deflate
+					// body there reads the whole body from the loop that delivers it
+					t.Skip("deflate over HTTP/2 deadlocks inside fhttp")
+				}
+				server := newOrigin(t, origin.protocol)
+				response := finalResponse(t, bridgeRequest(t, map[string]any{
+					"requestUrl": server.URL + "/compressed/" + encoding,
+					// sent by every browser profile of the Python client, which leaves decoding to the bridge
+					"headers": map[string]string{"accept-encoding": "gzip, deflate, br"},
+				}))
+				if response.Body != "hello compressed" {
+					t.Errorf("body %q, want it decompressed", response.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestSlowBodies(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+
+	// data keeps trickling in, never idle for the read timeout
+	response := finalResponse(t, bridgeRequest(t, map[string]any{
+		"requestUrl":    server.URL + "/slow?chunks=5&delay=50",
+		"readTimeoutMs": 500,
+	}))
+	if response.Body != "xxxxx" {
+		t.Errorf("body %q, want xxxxx", response.Body)
+	}
+
+	tests := []struct {
+		name  string
+		input map[string]any
+		limit string
+	}{
+		{"readTimeout", map[string]any{"requestUrl": server.URL + "/stall", "readTimeoutMs": 200}, "readTimeoutMs"},
+		{"timeout", map[string]any{"requestUrl": server.URL + "/slow?chunks=50&delay=50", "timeoutMs": 300}, "timeoutMs"},
+		{"budget", map[string]any{"requestUrl": server.URL + "/stall", "budgetMs": 200}, "budget"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := bridgeRequest(t, test.input).Response
+			if response.Status != 0 || response.Error == nil {
+				t.Fatalf("status %d, want the request to fail", response.Status)
+			}
+			if !strings.Contains(response.Error.Message, test.limit) {
+				t.Errorf("error %q doesn't mention %s", response.Error.Message, test.limit)
+			}
+		})
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	tests := []struct {
+		mode     string
+		value    string
+		encoding string
+	}{
+		{"", "café", "latin1"},
+		{"base64", "Y2Fm6Q==", "base64"},
+	}
+	for _, test := range tests {
+		t.Run("mode="+test.mode, func(t *testing.T) {
+			input := map[string]any{"requestUrl": server.URL + "/raw-header"}
+			if test.mode != "" {
+				input["invalidHeaderMode"] = test.mode
+			}
+			response := finalResponse(t, bridgeRequest(t, input))
+			if values := response.Headers["X-Latin1"]; len(values) != 1 || values[0] != test.value {
+				t.Errorf("header %v, want %q", values, test.value)
+			}
+			if response.EncodedHeaders["X-Latin1"] != test.encoding {
+				t.Errorf("encodedHeaders %v, want X-Latin1 as %s", response.EncodedHeaders, test.encoding)
+			}
+		})
+	}
+}
+
+func TestRequestCookieAttributes(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	sessionId := testSessionId(t)
+	response := finalResponse(t, bridgeRequest(t, map[string]any{
+		"sessionId":  sessionId,
+		"requestUrl": server.URL + "/echo",
+		"requestCookies": []map[string]any{
+			{"name": "plain", "value": "1", "path": "/"},
+			{"name": "secure", "value": "1", "path": "/", "secure": true},
+			{"name": "deleted", "value": "1", "path": "/", "maxAge": -1},
+			{"name": "strict", "value": "1", "path": "/", "httpOnly": true, "sameSite": "strict", "maxAge": 3600},
+		},
+	}))
+	cookies := echoed(t, response)["cookies"].(map[string]any)
+	if cookies["plain"] != "1" || cookies["strict"] != "1" {
+		t.Errorf("origin got cookies %v, want plain and strict", cookies)
+	}
+	if _, ok := cookies["secure"]; ok {
+		t.Error("secure cookie was sent over http")
+	}
+	if _, ok := cookies["deleted"]; ok {
+		t.Error("cookie with a negative maxAge was sent")
+	}
+
+	output := &CookiesFromSessionOutput{}
+	if err := json.Unmarshal(bridgePost(t, "/getCookiesFromSession", map[string]any{"sessionId": sessionId, "url": server.URL}), output); err != nil {
+		t.Fatal(err)
+	}
+	var strict *Cookie
+	for i, cookie := range output.Cookies {
+		if cookie.Name == "strict" {
+			strict = &output.Cookies[i]
+		}
+	}
+	if strict == nil || !strict.HttpOnly || strict.SameSite != "Strict" {
+		t.Errorf("session cookie %+v lost its attributes", strict)
+	}
+}
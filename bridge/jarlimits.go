@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+)
+
+/*
+Limits on the size of session cookie jars, evicting the least recently used cookies
+*/
+
+type CookieJarConfig struct {
+	// cookies kept per session, 0 for no limit
+	MaxCookies int `json:"maxCookies"`
+	// approximate bytes of cookie names, values, domains and paths kept per session, 0 for no limit
+	MaxBytes int `json:"maxBytes"`
+}
+
+type CookieJarStats struct {
+	Cookies int `json:"cookies"`
+	Bytes   int `json:"bytes"`
+	// cookies evicted to stay within the jar limits
+	Evicted int `json:"evicted"`
+}
+
+type jarEntry struct {
+	host     string
+	cookie   *http.Cookie
+	lastUsed time.Time
+}
+
+func getCookieJarLimits() CookieJarConfig {
+	if config := getServerConfig().CookieJar; config != nil {
+		return *config
+	}
+	return CookieJarConfig{}
+}
+
+// jarHostKey mirrors the host key tls-client files cookies under
+func jarHostKey(u *url.URL) string {
+	parts := strings.Split(u.Host, ".")
+	if len(parts) == 2 || len(parts) == 3 {
+		return fmt.Sprintf("%s.%s", parts[len(parts)-2], parts[len(parts)-1])
+	}
+	return u.Host
+}
+
+func jarCookieKey(host string, name string) string {
+	return host + "\x00" + name
+}
+
+func cookieSize(cookie *http.Cookie) int {
+	return len(cookie.Name) + len(cookie.Value) + len(cookie.Domain) + len(cookie.Path)
+}
+
+// touch records cookies as used now. Called with j.mu held
+func (j *clockJar) touch(u *url.URL, cookies []*http.Cookie) {
+	host := jarHostKey(u)
+	current := time.Now()
+	for _, cookie := range cookies {
+		j.lastUsed[jarCookieKey(host, cookie.Name)] = current
+	}
+}
+
+// entries lists the live cookies of the jar. Called with j.mu held
+func (j *clockJar) entries() []jarEntry {
+	jar, ok := j.jar.(tls_client.CookieJar)
+	if !ok {
+		return nil
+	}
+	var entries []jarEntry
+	for host, cookies := range jar.GetAllCookies() {
+		for _, cookie := range cookies {
+			// tls-client keeps deleted cookies around with a negative max age
+			if cookie.MaxAge < 0 {
+				continue
+			}
+			entries = append(entries, jarEntry{host: host, cookie: cookie, lastUsed: j.lastUsed[jarCookieKey(host, cookie.Name)]})
+		}
+	}
+	return entries
+}
+
+// enforceLimits evicts the least recently used cookies until the jar fits its limits.
+// tls-client jars can't remove cookies, so the jar is rebuilt from the ones kept. Called with j.mu held
+func (j *clockJar) enforceLimits() {
+	limits := getCookieJarLimits()
+	if limits.MaxCookies <= 0 && limits.MaxBytes <= 0 {
+		return
+	}
+	entries := j.entries()
+	size := 0
+	for _, entry := range entries {
+		size += cookieSize(entry.cookie)
+	}
+	within := func() bool {
+		return (limits.MaxCookies <= 0 || len(entries) <= limits.MaxCookies) && (limits.MaxBytes <= 0 || size <= limits.MaxBytes)
+	}
+	if within() {
+		return
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].lastUsed.Before(entries[b].lastUsed)
+	})
+	for len(entries) > 0 && !within() {
+		evicted := entries[0]
+		entries = entries[1:]
+		size -= cookieSize(evicted.cookie)
+		delete(j.lastUsed, jarCookieKey(evicted.host, evicted.cookie.Name))
+		j.evicted++
+	}
+
+	kept := make(map[string][]*http.Cookie)
+	for _, entry := range entries {
+		kept[entry.host] = append(kept[entry.host], entry.cookie)
+	}
+	fresh := tls_client.NewCookieJar()
+	for host, cookies := range kept {
+		fresh.SetCookies(&url.URL{Scheme: "https", Host: host}, cookies)
+	}
+	j.jar = fresh
+}
+
+func (j *clockJar) stats() CookieJarStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := CookieJarStats{Evicted: j.evicted}
+	for _, entry := range j.entries() {
+		stats.Cookies++
+		stats.Bytes += cookieSize(entry.cookie)
+	}
+	return stats
+}
+
+// sessionJarStats returns the cookie jar stats of a session, if it has a client
+func sessionJarStats(sessionId string) (CookieJarStats, bool) {
+	client, err := tls_client_cffi.GetClient(sessionId)
+	if err != nil {
+		return CookieJarStats{}, false
+	}
+	jar, ok := client.GetCookieJar().(*clockJar)
+	if !ok {
+		return CookieJarStats{}, false
+	}
+	return jar.stats(), true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+/*
+Control over the local end of outgoing connections: address family and source address
+*/
+
+// DialOptions apply to the connection leaving this host, which is the first proxy when one is used.
+// Hosts resolved by the proxy itself (http proxies and socks5h) aren't restricted to ipFamily
+type DialOptions struct {
+	// "ipv4" or "ipv6" to only connect over that address family
+	IpFamily string `json:"ipFamily,omitempty"`
+	// local address to connect from
+	SourceIp string `json:"sourceIp,omitempty"`
+	// connect from the address of this network interface, when sourceIp is not set
+	Interface string `json:"interface,omitempty"`
+}
+
+func (o *DialOptions) isEmpty() bool {
+	return o == nil || (o.IpFamily == "" && o.SourceIp == "" && o.Interface == "")
+}
+
+// sourceDialFunc returns a dialer connecting from the configured source address and family
+func sourceDialFunc(options *DialOptions) (dialFunc, error) {
+	if options.isEmpty() {
+		return directDial, nil
+	}
+	family := options.IpFamily
+	if family != "" && family != "ipv4" && family != "ipv6" {
+		return nil, fmt.Errorf("ipFamily must be ipv4 or ipv6, got %q", family)
+	}
+
+	var source net.IP
+	if options.SourceIp != "" {
+		if source = net.ParseIP(options.SourceIp); source == nil {
+			return nil, fmt.Errorf("invalid sourceIp %q", options.SourceIp)
+		}
+	} else if options.Interface != "" {
+		var err error
+		if source, err = interfaceAddress(options.Interface, family); err != nil {
+			return nil, err
+		}
+	}
+	if source != nil {
+		sourceFamily := ipFamily(source)
+		if family != "" && family != sourceFamily {
+			return nil, fmt.Errorf("source address %s is not %s", source, family)
+		}
+		// a source address only reaches targets of its own family
+		family = sourceFamily
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: dialTimeout}
+		if source != nil {
+			d.LocalAddr = &net.TCPAddr{IP: source}
+		}
+		return d.DialContext(ctx, familyNetwork(network, family), addr)
+	}, nil
+}
+
+// interfaceAddress returns the first address of the named interface, of the given family if set
+func interfaceAddress(name string, family string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface %q: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read addresses of interface %q: %w", name, err)
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (family != "" && ipFamily(ipNet.IP) != family) {
+			continue
+		}
+		// link-local addresses would need a zone, prefer anything else
+		if !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback != nil && family != "ipv6" {
+		return fallback, nil
+	}
+	if family != "" {
+		return nil, fmt.Errorf("interface %q has no %s address", name, family)
+	}
+	return nil, fmt.Errorf("interface %q has no address", name)
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// familyNetwork narrows "tcp" to "tcp4" or "tcp6"
+func familyNetwork(network string, family string) string {
+	switch family {
+	case "ipv4":
+		return network + "4"
+	case "ipv6":
+		return network + "6"
+	}
+	return network
+}
+
+// filterFamily keeps the ips of the given family, or all of them if family is empty
+func filterFamily(ips []net.IP, family string) []net.IP {
+	if family == "" {
+		return ips
+	}
+	var filtered []net.IP
+	for _, ip := range ips {
+		if ipFamily(ip) == family {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+func getDialOptions(requestInput *ExtendedRequestInput) *DialOptions {
+	if sessionId, withSession := inputSessionId(requestInput); withSession {
+		session := getSession(sessionId)
+		if requestInput.Dial != nil {
+			session.setDialOptions(requestInput.Dial)
+		}
+		if options := session.getDialOptions(); options != nil {
+			return options
+		}
+	} else if requestInput.Dial != nil {
+		return requestInput.Dial
+	}
+	return getServerConfig().Dial
+}
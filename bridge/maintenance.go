@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+)
+
+/*
+Operational endpoints for long-lived bridge processes
+*/
+
+type MemoryStats struct {
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapIdle     uint64 `json:"heapIdle"`
+	HeapReleased uint64 `json:"heapReleased"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"numGC"`
+	Goroutines   int    `json:"goroutines"`
+}
+
+type FlushOutput struct {
+	Before MemoryStats `json:"before"`
+	After  MemoryStats `json:"after"`
+	// DNS cache entries dropped
+	DnsEntries int `json:"dnsEntries"`
+	// cached robots.txt files dropped
+	RobotsEntries int `json:"robotsEntries"`
+	// bodies kept for storeBody requests dropped, only with ?storedBodies=true
+	StoredBodies int `json:"storedBodies"`
+	// sessions whose idle connections were closed
+	IdleClients int `json:"idleClients"`
+}
+
+func readMemoryStats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return MemoryStats{
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapIdle:     m.HeapIdle,
+		HeapReleased: m.HeapReleased,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		Goroutines:   runtime.NumGoroutine(),
+	}
+}
+
+func maintenanceFlushHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Clears the DNS and robots.txt caches, closes idle connections and returns memory to the OS.
+		Bodies kept with storeBody are only dropped when asked for with ?storedBodies=true
+	*/
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	output := FlushOutput{Before: readMemoryStats()}
+
+	output.DnsEntries = flushResolvers()
+	output.RobotsEntries = flushRobots()
+	if dropBodies, _ := strconv.ParseBool(r.URL.Query().Get("storedBodies")); dropBodies {
+		output.StoredBodies = storedBodies.flush()
+	}
+	for _, sessionId := range sessionIds() {
+		client, err := tls_client_cffi.GetClient(sessionId)
+		if err != nil {
+			continue
+		}
+		client.CloseIdleConnections()
+		output.IdleClients++
+	}
+	dohClient.CloseIdleConnections()
+
+	// FreeOSMemory also forces a garbage collection
+	debug.FreeOSMemory()
+	output.After = readMemoryStats()
+	writeJson(w, output)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	mathrand "math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Shadow traffic: a share of requests is replayed against a secondary target, proxy or profile.
+Mirrored requests bypass the rate limits, which are left to the requests they copy
+*/
+
+const (
+	maxMirrorResults = 1000
+	mirrorTimeout    = time.Minute
+)
+
+type MirrorConfig struct {
+	// share of requests mirrored, from 0 to 100
+	Percent float64 `json:"percent"`
+	// send mirrored requests to this scheme and host instead, e.g. "https://staging.example.com"
+	TargetUrl string `json:"targetUrl"`
+	// send mirrored requests through this proxy instead
+	ProxyUrl string `json:"proxyUrl"`
+	// send mirrored requests with this client identifier instead
+	TLSClientIdentifier string `json:"tlsClientIdentifier"`
+	// keep the outcome of mirrored requests for /mirror/log, otherwise they are discarded
+	Log bool `json:"log"`
+}
+
+type MirrorResult struct {
+	Time         string  `json:"time"`
+	Url          string  `json:"url"`
+	MirrorUrl    string  `json:"mirrorUrl"`
+	Status       int     `json:"status"`
+	MirrorStatus int     `json:"mirrorStatus"`
+	DurationMs   float64 `json:"durationMs"`
+	// error of the mirrored request, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	mirrorLock    sync.Mutex
+	mirrorResults []MirrorResult
+)
+
+func getMirrorConfig(requestInput *ExtendedRequestInput) *MirrorConfig {
+	if requestInput.Mirror != nil {
+		return requestInput.Mirror
+	}
+	return getServerConfig().Mirror
+}
+
+// startMirror replays a share of requests in the background. The returned function is called
+// with the primary response once it's known, so both outcomes can be logged together
+func startMirror(params *ExtendedRequestInput) func(primary *Response) {
+	config := getMirrorConfig(params)
+	if config == nil || config.Percent <= 0 || mathrand.Float64()*100 >= config.Percent {
+		return func(*Response) {}
+	}
+
+	mirrored := buildMirrorInput(params, config)
+	done := make(chan *Response, 1)
+	start, startedAt := time.Now(), now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+		done <- request(ctx, mirrored)
+	}()
+
+	return func(primary *Response) {
+		if !config.Log {
+			return
+		}
+		go func() {
+			response := <-done
+			result := MirrorResult{
+				Time:         startedAt.UTC().Format(time.RFC3339Nano),
+				Url:          params.RequestUrl,
+				MirrorUrl:    mirrored.RequestUrl,
+				MirrorStatus: response.Status,
+				DurationMs:   milliseconds(time.Since(start)),
+			}
+			if primary != nil {
+				result.Status = primary.Status
+			}
+			if response.Status == 0 {
+				result.Error = response.Body
+			}
+			addMirrorResult(result)
+		}()
+	}
+}
+
+// buildMirrorInput copies a request for mirroring, detached from the session and bridge-side
+// features that would notice the extra traffic
+func buildMirrorInput(params *ExtendedRequestInput, config *MirrorConfig) *ExtendedRequestInput {
+	mirrored := *params
+	mirrored.SessionId = nil
+	mirrored.StreamOutputPath = nil
+	mirrored.ProgressId = ""
+	mirrored.StoreBody = false
+	mirrored.RecordHar = nil
+	mirrored.Mirror = nil
+	mirrored.isMirror = true
+
+	if config.TargetUrl != "" {
+		if target, err := url.Parse(config.TargetUrl); err == nil {
+			if original, err := url.Parse(params.RequestUrl); err == nil {
+				original.Scheme, original.Host = target.Scheme, target.Host
+				mirrored.RequestUrl = original.String()
+			}
+		}
+	}
+	if config.ProxyUrl != "" {
+		proxyUrl := config.ProxyUrl
+		mirrored.ProxyUrl = &proxyUrl
+	}
+	if config.TLSClientIdentifier != "" {
+		mirrored.TLSClientIdentifier = config.TLSClientIdentifier
+		mirrored.CustomTlsClient = nil
+	}
+	return &mirrored
+}
+
+func addMirrorResult(result MirrorResult) {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	if len(mirrorResults) >= maxMirrorResults {
+		mirrorResults = mirrorResults[1:]
+	}
+	mirrorResults = append(mirrorResults, result)
+}
+
+func mirrorLogHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		GET returns the logged mirror results, DELETE clears them
+	*/
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		results := make([]MirrorResult, len(mirrorResults))
+		copy(results, mirrorResults)
+		writeJson(w, results)
+	case http.MethodDelete:
+		mirrorResults = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
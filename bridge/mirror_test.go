@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestMirrorBypassesRateLimit(t *testing.T) {
+	params := &ExtendedRequestInput{RateLimit: &RateLimitConfig{MaxRequestsPerSecond: 1}}
+	if getLimiter(params, "", false) == nil {
+		t.Fatal("request with a rate limit got no limiter")
+	}
+	mirrored := buildMirrorInput(params, &MirrorConfig{Percent: 100})
+	if getLimiter(mirrored, "", false) != nil {
+		t.Error("mirrored request shares the rate limiter of the requests it copies")
+	}
+}
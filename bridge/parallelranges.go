@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+/*
+Parallel download of large bodies as byte ranges. The segments go through the same client as the
+request, so they share its session, proxy and fingerprint, and are joined back into one body
+*/
+
+const (
+	defaultRangeSegments       = 4
+	maxRangeSegments           = 32
+	defaultRangeMinSegmentSize = 1024 * 1024
+)
+
+type ParallelRangesInput struct {
+	// segment requests in flight at once (default 4, at most 32)
+	Segments int `json:"segments"`
+	// smallest segment worth a request of its own (default 1 MiB). The first request asks for this many
+	// bytes, bodies no larger than that are fetched in one piece
+	MinSegmentBytes int64 `json:"minSegmentBytes"`
+}
+
+// RangeSegmentError is returned when one segment of a parallel download failed
+type RangeSegmentError struct {
+	Start int64
+	End   int64
+	Err   error
+}
+
+func (e *RangeSegmentError) Error() string {
+	return fmt.Sprintf("failed to download bytes %d-%d: %s", e.Start, e.End, e.Err)
+}
+
+func (e *RangeSegmentError) Unwrap() error {
+	return e.Err
+}
+
+func (input *ParallelRangesInput) settings() (int, int64) {
+	segments, minBytes := input.Segments, input.MinSegmentBytes
+	if segments <= 0 {
+		segments = defaultRangeSegments
+	}
+	if minBytes <= 0 {
+		minBytes = defaultRangeMinSegmentSize
+	}
+	return min(segments, maxRangeSegments), minBytes
+}
+
+// doInRanges sends req asking for its first segment only. When the server answers 206 with the full length,
+// the response is turned into a 200 whose body fetches the rest in parallel on first read and joins the
+// segments in order. Any other answer is returned as is, as is every request that isn't a plain GET.
+// Segment bodies are watched by watchdog, so data moving on any segment counts as activity
+func doInRanges(client tls_client.HttpClient, req *http.Request, input *ParallelRangesInput, watchdog *readWatchdog) (*http.Response, error) {
+	if req.Method != http.MethodGet || (req.Body != nil && req.Body != http.NoBody) || req.Header.Get("Range") != "" {
+		return client.Do(req)
+	}
+	segments, minBytes := input.settings()
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", minBytes-1))
+	// Content-Range counts bytes of the encoded body, and fhttp may decode each segment on its own
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// empty bodies have no first byte to ask for
+		resp.Body.Close()
+		req.Header.Del("Range")
+		return client.Do(req)
+	}
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		return resp, err
+	}
+	first, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || first.Start != 0 || first.Total < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unusable Content-Range %q in answer to a parallel download", resp.Header.Get("Content-Range"))
+	}
+
+	joined := *resp
+	joined.StatusCode = http.StatusOK
+	joined.Status = "200 OK"
+	joined.Header = resp.Header.Clone()
+	joined.Header.Del("Content-Range")
+	joined.Header.Set("Content-Length", strconv.FormatInt(first.Total, 10))
+	joined.ContentLength = first.Total
+
+	// resp.Request carries a context the client cancels once the first body is read, so the segments
+	// are derived from req, sent to wherever it was redirected
+	ctx, cancel := context.WithCancel(req.Context())
+	body := &rangedBody{first: resp.Body, cancel: cancel}
+	template := req.Clone(ctx)
+	template.URL, template.Host = resp.Request.URL, resp.Request.Host
+	if validator := rangeValidator(resp.Header); validator != "" {
+		template.Header.Set("If-Range", validator)
+	}
+
+	// split what is left into at most segments parts of at least minBytes
+	rest := first.Total - first.End - 1
+	if rest > 0 {
+		parts := min(int64(segments), (rest+minBytes-1)/minBytes)
+		size := (rest + parts - 1) / parts
+		for start := first.End + 1; start < first.Total; start += size {
+			body.segments = append(body.segments, &rangeSegment{
+				start: start,
+				end:   min(start+size, first.Total) - 1,
+				total: first.Total,
+				done:  make(chan struct{}),
+			})
+		}
+	}
+	body.fetch = func(segment *rangeSegment) {
+		segment.download(client, template, watchdog)
+	}
+	joined.Body = body
+	return &joined, nil
+}
+
+// rangeValidator returns the strong ETag or Last-Modified date segments are requested with as If-Range,
+// so a resource changing halfway through is answered with a 200 instead of mismatched bytes
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+type rangeSegment struct {
+	start int64
+	end   int64
+	total int64
+	data  []byte
+	err   error
+	// closed once data or err is set
+	done chan struct{}
+}
+
+func (s *rangeSegment) download(client tls_client.HttpClient, template *http.Request, watchdog *readWatchdog) {
+	defer close(s.done)
+	req := template.Clone(template.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.start, s.end))
+	resp, err := client.Do(req)
+	if err != nil {
+		s.err = &RangeSegmentError{Start: s.start, End: s.end, Err: err}
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		s.err = &RangeSegmentError{Start: s.start, End: s.end, Err: fmt.Errorf("server answered %d, the resource may have changed", resp.StatusCode)}
+		return
+	}
+	got, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || got.Start != s.start || got.End != s.end || got.Total != s.total {
+		s.err = &RangeSegmentError{Start: s.start, End: s.end, Err: fmt.Errorf("server sent Content-Range %q", resp.Header.Get("Content-Range"))}
+		return
+	}
+	data := make([]byte, 0, s.end-s.start+1)
+	buf := make([]byte, 32*1024)
+	body := watchdog.watchBody(resp.Body)
+	for {
+		n, err := body.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.err = &RangeSegmentError{Start: s.start, End: s.end, Err: err}
+			return
+		}
+	}
+	if int64(len(data)) != s.end-s.start+1 {
+		s.err = &RangeSegmentError{Start: s.start, End: s.end, Err: io.ErrUnexpectedEOF}
+		return
+	}
+	s.data = data
+}
+
+// rangedBody reads the body of the first response, then every segment in order as it completes
+type rangedBody struct {
+	first    io.ReadCloser
+	segments []*rangeSegment
+	// next segment to read
+	next   int
+	fetch  func(*rangeSegment)
+	start  sync.Once
+	cancel context.CancelFunc
+}
+
+func (b *rangedBody) Read(p []byte) (int, error) {
+	// segments are only fetched once the body is read, after its announced length was checked
+	b.start.Do(func() {
+		for _, segment := range b.segments {
+			go b.fetch(segment)
+		}
+	})
+	if b.first != nil {
+		n, err := b.first.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		b.first.Close()
+		b.first = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	for b.next < len(b.segments) {
+		segment := b.segments[b.next]
+		<-segment.done
+		if segment.err != nil {
+			return 0, segment.err
+		}
+		if len(segment.data) > 0 {
+			n := copy(p, segment.data)
+			segment.data = segment.data[n:]
+			return n, nil
+		}
+		b.next++
+	}
+	return 0, io.EOF
+}
+
+// Close aborts the segments still downloading
+func (b *rangedBody) Close() error {
+	b.cancel()
+	if b.first != nil {
+		return b.first.Close()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParallelRanges(t *testing.T) {
+	for _, origin := range originProtocols {
+		t.Run(origin.protocol, func(t *testing.T) {
+			server := newOrigin(t, origin.protocol)
+			for _, size := range []int{100000, 999, 0} {
+				response := finalResponse(t, bridgeRequest(t, map[string]any{
+					"requestUrl":     server.URL + "/file?size=" + strconv.Itoa(size),
+					"isByteResponse": true,
+					"parallelRanges": map[string]any{"segments": 4, "minSegmentBytes": 1000},
+				}))
+				if response.Status != 200 {
+					t.Fatalf("size %d: status %d, want the segments joined into a 200", size, response.Status)
+				}
+				_, encoded, _ := strings.Cut(response.Body, ",")
+				body, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(body) != size {
+					t.Fatalf("size %d: got %d bytes", size, len(body))
+				}
+				for i, b := range body {
+					if b != rangeFileByte(i) {
+						t.Fatalf("size %d: byte %d is %d, want %d", size, i, b, rangeFileByte(i))
+					}
+				}
+			}
+
+			// servers ignoring Range are read as usual
+			response := finalResponse(t, bridgeRequest(t, map[string]any{
+				"requestUrl":     server.URL + "/echo",
+				"parallelRanges": map[string]any{},
+			}))
+			if echoed(t, response)["method"] != "GET" {
+				t.Errorf("echo body %q", response.Body)
+			}
+		})
+	}
+}
+
+func TestRangedBodyJoinsSegmentsInOrder(t *testing.T) {
+	segments := []*rangeSegment{
+		{start: 2, end: 3, done: make(chan struct{})},
+		{start: 4, end: 5, done: make(chan struct{})},
+		{start: 6, end: 7, done: make(chan struct{})},
+	}
+	data := map[int64]string{2: "cd", 4: "ef", 6: "gh"}
+	canceled := false
+	body := &rangedBody{
+		first:    io.NopCloser(strings.NewReader("ab")),
+		segments: segments,
+		// every segment but the last waits for the one after it, so they complete last to first
+		fetch: func(segment *rangeSegment) {
+			for i, next := range segments[:len(segments)-1] {
+				if next == segment {
+					<-segments[i+1].done
+				}
+			}
+			segment.data = []byte(data[segment.start])
+			close(segment.done)
+		},
+		cancel: func() { canceled = true },
+	}
+	joined, err := io.ReadAll(body)
+	if err != nil || string(joined) != "abcdefgh" {
+		t.Errorf("read %q (%v), want abcdefgh", joined, err)
+	}
+	body.Close()
+	if !canceled {
+		t.Error("closing the body didn't cancel the segments")
+	}
+
+	// a failed segment fails the read once reached
+	failed := errors.New("reset")
+	body = &rangedBody{
+		first:    io.NopCloser(strings.NewReader("ab")),
+		segments: []*rangeSegment{{start: 2, end: 3, done: make(chan struct{})}},
+		fetch: func(segment *rangeSegment) {
+			segment.err = &RangeSegmentError{Start: segment.start, End: segment.end, Err: failed}
+			close(segment.done)
+		},
+		cancel: func() {},
+	}
+	if joined, err := io.ReadAll(body); !errors.Is(err, failed) || string(joined) != "ab" {
+		t.Errorf("read %q (%v), want ab and the segment error", joined, err)
+	}
+}
+
+func TestParallelRangesSettings(t *testing.T) {
+	tests := []struct {
+		input    ParallelRangesInput
+		segments int
+		minBytes int64
+	}{
+		{ParallelRangesInput{}, defaultRangeSegments, defaultRangeMinSegmentSize},
+		{ParallelRangesInput{Segments: 8, MinSegmentBytes: 100}, 8, 100},
+		{ParallelRangesInput{Segments: 1000, MinSegmentBytes: -1}, maxRangeSegments, defaultRangeMinSegmentSize},
+	}
+	for _, test := range tests {
+		if segments, minBytes := test.input.settings(); segments != test.segments || minBytes != test.minBytes {
+			t.Errorf("%+v: %d segments of %d bytes, want %d of %d", test.input, segments, minBytes, test.segments, test.minBytes)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Saves sessions to disk and restores them, so long-running clients survive bridge restarts.
+tls-client keeps its TLS session cache private, so resumption state can't be carried over
+*/
+
+const sessionSnapshotVersion = 1
+
+type SessionSnapshot struct {
+	Version   int    `json:"version"`
+	SessionId string `json:"sessionId"`
+	// incremented on every save to the session store
+	Revision int64 `json:"revision,omitempty"`
+	// client profile, header order and other options the session was built from
+	ClientInput tls_client_cffi.RequestInput `json:"clientInput"`
+	ProxyChain  []string                     `json:"proxyChain,omitempty"`
+	Resolver    *ResolverConfig              `json:"resolver,omitempty"`
+	Dial        *DialOptions                 `json:"dial,omitempty"`
+	RateLimit   *RateLimitConfig             `json:"rateLimit,omitempty"`
+	ProxyAuth   bool                         `json:"proxyAuth,omitempty"`
+	Label       string                       `json:"label,omitempty"`
+	// cookie jar contents keyed by host
+	Cookies map[string][]*http.Cookie `json:"cookies"`
+}
+
+type SessionSaveInput struct {
+	Path string `json:"path"`
+}
+
+type SessionRestoreInput struct {
+	Path string `json:"path"`
+	// restore under a different id than the one saved
+	SessionId string `json:"sessionId"`
+}
+
+type SessionPersistOutput struct {
+	SessionId string `json:"sessionId"`
+	Path      string `json:"path"`
+	Cookies   int    `json:"cookies"`
+}
+
+// snapshotSession captures the state of a session created by the bridge
+func snapshotSession(sessionId string) (*SessionSnapshot, error) {
+	client, err := tls_client_cffi.GetClient(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	session := getSession(sessionId)
+	input, ok := session.getClientInput()
+	if !ok {
+		return nil, fmt.Errorf("session %s was not created by the bridge", sessionId)
+	}
+
+	snapshot := &SessionSnapshot{
+		Version:   sessionSnapshotVersion,
+		SessionId: sessionId,
+		Resolver:  session.getResolver(),
+		Dial:      session.getDialOptions(),
+		ProxyAuth: session.getProxyAuth(),
+		Cookies:   map[string][]*http.Cookie{},
+	}
+	session.mu.Lock()
+	snapshot.RateLimit = session.rateLimitConfig
+	snapshot.Label = session.label
+	session.mu.Unlock()
+
+	// the proxy currently set may be a dial shim, save what it stands for
+	if proxyUrl := client.GetProxy(); proxyUrl != "" {
+		input.ProxyUrl = &proxyUrl
+		if config, ok := lookupDialShim(proxyUrl); ok {
+			input.ProxyUrl = &config.ProxyUrl
+			snapshot.ProxyChain = config.ProxyChain
+			if snapshot.Resolver == nil {
+				snapshot.Resolver = config.Resolver
+			}
+			if snapshot.Dial == nil {
+				snapshot.Dial = config.Local
+			}
+		}
+	}
+	input.FollowRedirects = client.GetFollowRedirect()
+	snapshot.ClientInput = input
+
+	if jar, ok := client.GetCookieJar().(interface {
+		GetAllCookies() map[string][]*http.Cookie
+	}); ok {
+		for host, cookies := range jar.GetAllCookies() {
+			snapshot.Cookies[host] = cookies
+		}
+	}
+	return snapshot, nil
+}
+
+// restoreSession recreates a session's client from a snapshot, replacing the client of any session with the same id.
+// The session state is kept, so requests in flight, the HAR log and unchanged rate limits carry over
+func restoreSession(snapshot *SessionSnapshot) (int, error) {
+	if snapshot.Version != sessionSnapshotVersion {
+		return 0, fmt.Errorf("unsupported session snapshot version %d", snapshot.Version)
+	}
+	sessionId := snapshot.SessionId
+	tls_client_cffi.RemoveSession(sessionId)
+
+	session := getSession(sessionId)
+	session.mu.Lock()
+	session.label = snapshot.Label
+	session.proxyAuth = snapshot.ProxyAuth
+	session.mu.Unlock()
+	session.setRateLimit(snapshot.RateLimit)
+	session.setResolver(snapshot.Resolver)
+	session.setDialOptions(snapshot.Dial)
+
+	params := &ExtendedRequestInput{RequestInput: snapshot.ClientInput, ProxyChain: snapshot.ProxyChain}
+	params.SessionId = &sessionId
+	clientInput, clientErr := buildClientInput(params)
+	var client tls_client.HttpClient
+	if clientErr == nil {
+		client, _, _, clientErr = tls_client_cffi.CreateClient(clientInput)
+	}
+	if clientErr != nil {
+		return 0, clientErr
+	}
+	session.setClientInput(clientInput)
+	installClockJar(client)
+
+	restored := 0
+	for host, cookies := range snapshot.Cookies {
+		client.SetCookies(&url.URL{Scheme: "https", Host: host}, cookies)
+		restored += len(cookies)
+	}
+	return restored, nil
+}
+
+func sessionSaveHandler(w http.ResponseWriter, r *http.Request, sessionId string) {
+	/*
+		Writes the session's state to the file at "path"
+	*/
+	rawData := extractBody(w, r)
+	if rawData == nil {
+		return
+	}
+	input := SessionSaveInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("session save", err), http.StatusBadRequest)
+		return
+	}
+	if input.Path == "" {
+		http.Error(w, "Invalid JSON format for session save, path is required", http.StatusBadRequest)
+		return
+	}
+
+	snapshot, err := snapshotSession(sessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		http.Error(w, "Failed to marshal session", http.StatusInternalServerError)
+		return
+	}
+	// the file holds credentials, keep it private
+	if err := os.WriteFile(input.Path, encoded, 0o600); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	count := 0
+	for _, cookies := range snapshot.Cookies {
+		count += len(cookies)
+	}
+	writeJson(w, SessionPersistOutput{SessionId: sessionId, Path: input.Path, Cookies: count})
+}
+
+func sessionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Recreates a session from a file written by /session/{id}/save
+	*/
+	rawData := extractBody(w, r)
+	if rawData == nil {
+		return
+	}
+	input := SessionRestoreInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("session restore", err), http.StatusBadRequest)
+		return
+	}
+	if input.Path == "" {
+		http.Error(w, "Invalid JSON format for session restore, path is required", http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := os.ReadFile(input.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	snapshot := &SessionSnapshot{}
+	if err := json.Unmarshal(encoded, snapshot); err != nil {
+		http.Error(w, fmt.Sprintf("invalid session file: %s", err), http.StatusBadRequest)
+		return
+	}
+	if input.SessionId != "" {
+		snapshot.SessionId = input.SessionId
+	}
+
+	count, err := restoreSession(snapshot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, SessionPersistOutput{SessionId: snapshot.SessionId, Path: input.Path, Cookies: count})
+}
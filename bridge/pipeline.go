@@ -0,0 +1,256 @@
+//go:build !no_extraction
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Pipelines run dependent requests in order, feeding values extracted from one step into the next
+*/
+
+func init() {
+	registerCapability("extraction", true)
+}
+
+type PipelineInput struct {
+	Steps []PipelineStep `json:"steps"`
+}
+
+type PipelineStep struct {
+	// request to send, string fields may reference earlier extractions as {{name}}
+	Request json.RawMessage `json:"request"`
+	// values to extract from the response, by name
+	Extract map[string]Extractor `json:"extract"`
+}
+
+type Extractor struct {
+	// "body" (default), "header", "cookie", "status" or "url"
+	From string `json:"from"`
+	// header or cookie name
+	Name string `json:"name"`
+	// path into a JSON body, e.g. "$.data.items[0].token"
+	JsonPath string `json:"jsonPath"`
+	// applied after jsonPath, the first capture group is used if there is one
+	Regex string `json:"regex"`
+	// don't fail the pipeline if nothing was found
+	Optional bool `json:"optional"`
+}
+
+type PipelineOutput struct {
+	// results of the steps that ran, in order
+	Steps     []any             `json:"steps"`
+	Variables map[string]string `json:"variables"`
+	// index of the step that stopped the pipeline
+	FailedStep *int   `json:"failedStep,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+var pipelineReference = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Runs the steps of a pipeline in order, stopping at the first failure
+	*/
+	rawData := extractBody(w, r)
+	input := PipelineInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("pipeline", err), http.StatusBadRequest)
+		return
+	}
+
+	output := PipelineOutput{Steps: []any{}, Variables: make(map[string]string)}
+	for i, step := range input.Steps {
+		fail := func(err error) {
+			output.FailedStep = &i
+			output.Error = fmt.Sprintf("step %d: %s", i, err)
+		}
+
+		params := ExtendedRequestInput{}
+		rawRequest, err := expandReferences(step.Request, output.Variables)
+		if err == nil {
+			err = decodeJson(r, rawRequest, &params)
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		wrapper := fetch(r.Context(), &params)
+		output.Steps = append(output.Steps, wrapResponse(&params, wrapper))
+
+		response := wrapper.Response
+		if wrapper.IsHistory && len(wrapper.History) > 0 {
+			response = wrapper.History[len(wrapper.History)-1]
+		}
+		if response == nil || response.Status == 0 {
+			message := "request failed"
+			if response != nil {
+				message = response.Body
+			}
+			fail(fmt.Errorf("%s", message))
+			break
+		}
+
+		for name, extractor := range step.Extract {
+			value, err := extractor.extract(response)
+			if err != nil && !extractor.Optional {
+				fail(fmt.Errorf("extracting %s: %w", name, err))
+				break
+			}
+			if err == nil {
+				output.Variables[name] = value
+			}
+		}
+		if output.FailedStep != nil {
+			break
+		}
+	}
+	writeJson(w, output)
+}
+
+// expandReferences substitutes {{name}} references inside the JSON strings of a step's request
+func expandReferences(rawRequest json.RawMessage, variables map[string]string) (json.RawMessage, error) {
+	var missing string
+	expanded := pipelineReference.ReplaceAllFunc(rawRequest, func(match []byte) []byte {
+		name := string(pipelineReference.FindSubmatch(match)[1])
+		value, ok := variables[name]
+		if !ok {
+			missing = name
+			return match
+		}
+		// escape the value for use inside a JSON string
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	if missing != "" {
+		return nil, fmt.Errorf("reference to unknown value %s", missing)
+	}
+	return expanded, nil
+}
+
+func (e Extractor) extract(response *Response) (string, error) {
+	var source string
+	switch e.From {
+	case "", "body":
+		source = response.Body
+	case "header":
+		values := http.Header(response.Headers).Values(e.Name)
+		if len(values) == 0 {
+			return "", fmt.Errorf("no %s header", e.Name)
+		}
+		source = values[0]
+	case "cookie":
+		value, ok := response.Cookies[e.Name]
+		if !ok {
+			return "", fmt.Errorf("no %s cookie", e.Name)
+		}
+		source = value
+	case "status":
+		source = strconv.Itoa(response.Status)
+	case "url":
+		source = response.Target
+	default:
+		return "", fmt.Errorf("unknown extractor source %q", e.From)
+	}
+
+	if e.JsonPath != "" {
+		var document any
+		if err := json.Unmarshal([]byte(source), &document); err != nil {
+			return "", fmt.Errorf("body is not JSON: %w", err)
+		}
+		value, err := evalJsonPath(document, e.JsonPath)
+		if err != nil {
+			return "", err
+		}
+		source = value
+	}
+
+	if e.Regex != "" {
+		pattern, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return "", err
+		}
+		match := pattern.FindStringSubmatch(source)
+		if match == nil {
+			return "", fmt.Errorf("regex %s did not match", e.Regex)
+		}
+		if len(match) > 1 {
+			return match[1], nil
+		}
+		return match[0], nil
+	}
+	return source, nil
+}
+
+// evalJsonPath follows a "$.key.list[0]['other key']" path through a decoded JSON document.
+// Strings are returned as is, anything else as JSON
+func evalJsonPath(document any, path string) (string, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	current := document
+	for rest != "" {
+		var key string
+		index := -1
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key, rest = rest[:end], rest[end:]
+		case strings.HasPrefix(rest, "['"), strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], string(rest[1])+"]")
+			if end < 0 {
+				return "", fmt.Errorf("unterminated key in jsonPath %s", path)
+			}
+			key, rest = rest[2:2+end], rest[2+end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", fmt.Errorf("unterminated index in jsonPath %s", path)
+			}
+			var err error
+			index, err = strconv.Atoi(rest[1:end])
+			if err != nil {
+				return "", fmt.Errorf("invalid index in jsonPath %s", path)
+			}
+			rest = rest[end+1:]
+		default:
+			return "", fmt.Errorf("invalid jsonPath %s", path)
+		}
+
+		if index >= 0 {
+			list, ok := current.([]any)
+			if !ok || index >= len(list) {
+				return "", fmt.Errorf("jsonPath %s: index %d not found", path, index)
+			}
+			current = list[index]
+			continue
+		}
+		object, ok := current.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("jsonPath %s: key %s not found", path, key)
+		}
+		if current, ok = object[key]; !ok {
+			return "", fmt.Errorf("jsonPath %s: key %s not found", path, key)
+		}
+	}
+
+	if value, ok := current.(string); ok {
+		return value, nil
+	}
+	encoded, err := json.Marshal(current)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
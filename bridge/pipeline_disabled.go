@@ -0,0 +1,15 @@
+//go:build no_extraction
+
+package main
+
+import (
+	http "github.com/bogdanfinn/fhttp"
+)
+
+func init() {
+	registerCapability("extraction", false)
+}
+
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	capabilityMissing(w, "extraction")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+/*
+Upload and download progress of requests tagged with a progressId, served through long-polling
+*/
+
+const (
+	progressInterval     = 100 * time.Millisecond
+	progressRetention    = time.Minute
+	maxProgressPollDelay = 30 * time.Second
+)
+
+type Progress struct {
+	ProgressId string `json:"progressId"`
+	// incremented on every update, pass it back as ?since= to wait for the next one
+	Version int64 `json:"version"`
+	// "upload", "download" or "done"
+	Phase    string `json:"phase"`
+	Uploaded int64  `json:"uploaded"`
+	// total upload size, -1 if unknown
+	UploadTotal int64 `json:"uploadTotal"`
+	Downloaded  int64 `json:"downloaded"`
+	// total download size as announced by Content-Length, -1 if unknown
+	DownloadTotal int64 `json:"downloadTotal"`
+	// bytes per second over the current phase
+	Rate  float64 `json:"rate"`
+	Done  bool    `json:"done"`
+	Error string  `json:"error,omitempty"`
+}
+
+type progressTracker struct {
+	mu         sync.Mutex
+	progress   Progress
+	phaseStart time.Time
+	lastUpdate time.Time
+	// closed and replaced whenever a new version is published
+	changed chan struct{}
+}
+
+var (
+	progressLock     sync.Mutex
+	progressTrackers = make(map[string]*progressTracker)
+)
+
+// startProgress registers a tracker for progressId, replacing any earlier one
+func startProgress(progressId string) *progressTracker {
+	t := &progressTracker{
+		progress: Progress{ProgressId: progressId, UploadTotal: -1, DownloadTotal: -1},
+		changed:  make(chan struct{}),
+	}
+	progressLock.Lock()
+	progressTrackers[progressId] = t
+	progressLock.Unlock()
+	return t
+}
+
+func getProgressTracker(progressId string) *progressTracker {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	return progressTrackers[progressId]
+}
+
+// getProgress returns the tracker of a request, or nil if it doesn't report progress
+func getProgress(requestInput *ExtendedRequestInput) *progressTracker {
+	if requestInput.ProgressId == "" {
+		return nil
+	}
+	return getProgressTracker(requestInput.ProgressId)
+}
+
+// publish bumps the version and wakes up pollers, must be called with t.mu held
+func (t *progressTracker) publish() {
+	now := time.Now()
+	if elapsed := now.Sub(t.phaseStart).Seconds(); elapsed > 0 {
+		transferred := t.progress.Downloaded
+		if t.progress.Phase == "upload" {
+			transferred = t.progress.Uploaded
+		}
+		t.progress.Rate = float64(transferred) / elapsed
+	}
+	t.progress.Version++
+	t.lastUpdate = now
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// beginPhase resets the counters of phase, which is "upload" or "download"
+func (t *progressTracker) beginPhase(phase string, total int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Phase = phase
+	t.phaseStart = time.Now()
+	if phase == "upload" {
+		t.progress.Uploaded, t.progress.UploadTotal = 0, total
+	} else {
+		t.progress.Downloaded, t.progress.DownloadTotal = 0, total
+	}
+	t.publish()
+}
+
+// add counts n transferred bytes, publishing at most once per progressInterval
+func (t *progressTracker) add(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress.Phase == "upload" {
+		t.progress.Uploaded += n
+	} else {
+		t.progress.Downloaded += n
+	}
+	if time.Since(t.lastUpdate) >= progressInterval {
+		t.publish()
+	}
+}
+
+// finish publishes the final state and forgets the tracker after progressRetention
+func (t *progressTracker) finish(errorMessage string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.progress.Phase = "done"
+	t.progress.Done = true
+	t.progress.Error = errorMessage
+	t.publish()
+	t.mu.Unlock()
+
+	time.AfterFunc(progressRetention, func() {
+		progressLock.Lock()
+		defer progressLock.Unlock()
+		if progressTrackers[t.progress.ProgressId] == t {
+			delete(progressTrackers, t.progress.ProgressId)
+		}
+	})
+}
+
+// wait returns the progress once its version is past since, or the current one when timeout expires
+func (t *progressTracker) wait(since int64, timeout time.Duration) Progress {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.mu.Lock()
+		progress, changed := t.progress, t.changed
+		t.mu.Unlock()
+		if progress.Version > since || progress.Done {
+			return progress
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return progress
+		}
+	}
+}
+
+// trackBody counts bytes read from body towards the current phase of t
+func (t *progressTracker) trackBody(body io.ReadCloser) io.ReadCloser {
+	if t == nil || body == nil {
+		return body
+	}
+	return &progressReader{ReadCloser: body, tracker: t}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	if n > 0 {
+		p.tracker.add(int64(n))
+	}
+	return n, err
+}
+
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Long-polls /progress/{id}?since={version}&timeoutMs={ms} for the next progress update
+	*/
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	progressId := strings.Trim(strings.TrimPrefix(r.URL.Path, "/progress/"), "/")
+	tracker := getProgressTracker(progressId)
+	if progressId == "" || tracker == nil {
+		http.Error(w, fmt.Sprintf("no progress found for progressId: %s", progressId), http.StatusNotFound)
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	timeout := maxProgressPollDelay
+	if timeoutMs, err := strconv.Atoi(r.URL.Query().Get("timeoutMs")); err == nil && timeoutMs >= 0 {
+		timeout = min(time.Duration(timeoutMs)*time.Millisecond, maxProgressPollDelay)
+	}
+	writeJson(w, tracker.wait(since, timeout))
+}
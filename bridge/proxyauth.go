@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+)
+
+/*
+Proxy authentication (407) handling for tunnels opened by the dial shim
+*/
+
+// ProxyAuthError is returned when a proxy rejects the supplied credentials
+type ProxyAuthError struct {
+	// auth scheme that was attempted, empty if the proxy url had no credentials
+	Scheme string
+	Status string
+	Err    error
+}
+
+func (e *ProxyAuthError) Error() string {
+	msg := "proxy authentication failed: " + e.Status
+	if e.Scheme != "" {
+		msg += " (tried " + e.Scheme + " auth)"
+	} else {
+		msg += " (no credentials in proxy url)"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ProxyAuthError) Unwrap() error {
+	return e.Err
+}
+
+// isProxyAuthFailure reports whether tls-client failed because the proxy answered CONNECT with a 407
+func isProxyAuthFailure(err error) bool {
+	return strings.Contains(err.Error(), "non 200 code: 407")
+}
+
+func hasProxyCredentials(proxyUrl *string) bool {
+	if proxyUrl == nil {
+		return false
+	}
+	parsed, err := url.Parse(*proxyUrl)
+	return err == nil && parsed.User != nil && parsed.User.Username() != ""
+}
+
+func basicAuthorization(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// findChallenge returns the parameters of the first challenge using scheme
+func findChallenge(headers []string, scheme string) (map[string]string, bool) {
+	for _, header := range headers {
+		name, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if strings.EqualFold(name, scheme) {
+			return parseAuthParams(rest), true
+		}
+	}
+	return nil, false
+}
+
+// parseAuthParams parses comma separated key=value pairs, values optionally quoted
+func parseAuthParams(raw string) map[string]string {
+	params := make(map[string]string)
+	for len(raw) > 0 {
+		raw = strings.TrimLeft(raw, " ,")
+		key, rest, ok := strings.Cut(raw, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(rest[1:min(end, len(rest))], "\\", "")
+			rest = rest[min(end+1, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+		raw = rest
+	}
+	return params
+}
+
+// digestAuthorization answers a Digest challenge (RFC 7616)
+func digestAuthorization(challenge map[string]string, username, password, method, uri string) (string, error) {
+	algorithm := challenge["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	digest := func(data string) string {
+		h := newHash()
+		h.Write([]byte(data))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	realm, nonce := challenge["realm"], challenge["nonce"]
+	cnonce := randomHex(8)
+	nc := "00000001"
+
+	ha1 := digest(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = digest(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := digest(method + ":" + uri)
+
+	qop := ""
+	for _, option := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if qop != "" {
+		response = digest(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = digest(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, username, realm, nonce, uri, response)
+	if algorithm != "" {
+		authorization += ", algorithm=" + algorithm
+	}
+	if qop != "" {
+		authorization += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return authorization, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	stdhttp "net/http"
+	"net/url"
+	"testing"
+)
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestProxy answers CONNECT with a Digest challenge, opening the tunnel once a request carries
+// the response expected for user:secret, then echoes what is sent through the tunnel
+func digestProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := stdhttp.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				params, ok := findChallenge([]string{req.Header.Get("Proxy-Authorization")}, "Digest")
+				ha1 := md5Hex("user:test:secret")
+				ha2 := md5Hex("CONNECT:" + req.Host)
+				if !ok || params["username"] != "user" || params["uri"] != req.Host ||
+					params["response"] != md5Hex(ha1+":abc:"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2) {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+						"Proxy-Authenticate: Basic realm=\"test\"\r\n"+
+						"Proxy-Authenticate: Digest realm=\"test\", nonce=\"abc\", qop=\"auth,auth-int\", opaque=\"xyz\"\r\n"+
+						"Content-Length: 0\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDigestProxyAuth(t *testing.T) {
+	address := digestProxy(t)
+
+	proxyUrl := &url.URL{Scheme: "http", Host: address, User: url.UserPassword("user", "secret")}
+	conn, err := dialConnect(context.Background(), proxyUrl, directDial, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("tunnel echoed %q (%v)", echo, err)
+	}
+
+	proxyUrl.User = url.UserPassword("user", "wrong")
+	_, err = dialConnect(context.Background(), proxyUrl, directDial, "example.com:443")
+	var authErr *ProxyAuthError
+	if !errors.As(err, &authErr) || authErr.Scheme != "Digest" {
+		t.Errorf("wrong password failed with %v, want a Digest ProxyAuthError", err)
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	challenge := map[string]string{"realm": "test", "nonce": "abc", "opaque": "xyz"}
+	// without qop the response only covers the nonce (RFC 2069)
+	authorization, err := digestAuthorization(challenge, "user", "secret", "CONNECT", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := findChallenge([]string{authorization}, "Digest")
+	want := md5Hex(md5Hex("user:test:secret") + ":abc:" + md5Hex("CONNECT:example.com:443"))
+	if params["response"] != want || params["opaque"] != "xyz" || params["qop"] != "" {
+		t.Errorf("authorization %s, want response %s echoing the opaque value", authorization, want)
+	}
+
+	for _, algorithm := range []string{"SHA-256", "MD5-sess", "SHA-256-sess"} {
+		challenge := map[string]string{"realm": "test", "nonce": "abc", "qop": "auth", "algorithm": algorithm}
+		authorization, err := digestAuthorization(challenge, "user", "secret", "CONNECT", "example.com:443")
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+			continue
+		}
+		if params, _ := findChallenge([]string{authorization}, "Digest"); params["algorithm"] != algorithm || params["cnonce"] == "" {
+			t.Errorf("%s: authorization %s", algorithm, authorization)
+		}
+	}
+	if _, err := digestAuthorization(map[string]string{"algorithm": "SHA-512-256"}, "user", "secret", "CONNECT", "example.com:443"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Token bucket rate limiting keyed by host
+*/
+
+type RateLimitConfig struct {
+	MaxRequestsPerSecond float64 `json:"maxRequestsPerSecond"`
+	Burst                int     `json:"burst"`
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller has to wait before using it.
+// tokens may go negative, which queues callers behind each other
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back a token reserved by a caller that gave up waiting
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// idleSince reports whether the bucket was last used before cutoff and has refilled since,
+// so dropping it changes nothing
+func (b *tokenBucket) idleSince(cutoff time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.Before(cutoff) {
+		return false
+	}
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.burst
+}
+
+// buckets and ad hoc limiters unused for this long are dropped once they refilled
+const limiterIdleTimeout = 10 * time.Minute
+
+type hostLimiter struct {
+	config  RateLimitConfig
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// when idle buckets were last dropped, and when the limiter was last used
+	pruned   time.Time
+	lastUsed time.Time
+}
+
+func newHostLimiter(config *RateLimitConfig) *hostLimiter {
+	// a nil limiter means no rate limiting
+	if config == nil || config.MaxRequestsPerSecond <= 0 {
+		return nil
+	}
+	return buildHostLimiter(*config)
+}
+
+// buildHostLimiter returns a limiter even without a rate, for callers setting it per host
+func buildHostLimiter(config RateLimitConfig) *hostLimiter {
+	return &hostLimiter{
+		config:   config,
+		buckets:  make(map[string]*tokenBucket),
+		pruned:   time.Now(),
+		lastUsed: time.Now(),
+	}
+}
+
+func (l *hostLimiter) bucket(host string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.lastUsed = now
+	if now.Sub(l.pruned) > limiterIdleTimeout {
+		l.prune(now)
+	}
+	host = strings.ToLower(host)
+	b, ok := l.buckets[host]
+	if !ok {
+		b = newTokenBucket(l.config.MaxRequestsPerSecond, l.config.Burst)
+		l.buckets[host] = b
+	}
+	return b
+}
+
+// prune drops the buckets idle for limiterIdleTimeout, must be called with l.mu held
+func (l *hostLimiter) prune(now time.Time) {
+	l.pruned = now
+	cutoff := now.Add(-limiterIdleTimeout)
+	for host, b := range l.buckets {
+		if b.idleSince(cutoff) {
+			delete(l.buckets, host)
+		}
+	}
+}
+
+// idle reports whether the limiter went unused for limiterIdleTimeout and holds no state worth keeping
+func (l *hostLimiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastUsed) <= limiterIdleTimeout {
+		return false
+	}
+	l.prune(now)
+	return len(l.buckets) == 0
+}
+
+// wait blocks until a request to host is allowed, failing early if ctx would expire first
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	return waitBucket(ctx, l.bucket(host))
+}
+
+// setHostRate overrides the rate of a single host
+func (l *hostLimiter) setHostRate(host string, rate float64) {
+	b := l.bucket(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+}
+
+// waitBucket waits for a token of b, which is given back when the wait is abandoned
+func waitBucket(ctx context.Context, b *tokenBucket) error {
+	delay := b.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		b.refund()
+		return fmt.Errorf("rate limit delay of %s exceeds the remaining time budget", delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.refund()
+		return ctx.Err()
+	}
+}
+
+var (
+	adhocLimitersLock   sync.Mutex
+	adhocLimiters       = make(map[RateLimitConfig]*hostLimiter)
+	adhocLimitersPruned = time.Now()
+)
+
+// getAdhocLimiter returns a limiter shared by all sessionless requests using the same config
+func getAdhocLimiter(config RateLimitConfig) *hostLimiter {
+	adhocLimitersLock.Lock()
+	defer adhocLimitersLock.Unlock()
+
+	if now := time.Now(); now.Sub(adhocLimitersPruned) > limiterIdleTimeout {
+		adhocLimitersPruned = now
+		for other, limiter := range adhocLimiters {
+			if limiter == nil || limiter.idle(now) {
+				delete(adhocLimiters, other)
+			}
+		}
+	}
+	limiter, ok := adhocLimiters[config]
+	if !ok {
+		limiter = newHostLimiter(&config)
+		adhocLimiters[config] = limiter
+	}
+	return limiter
+}
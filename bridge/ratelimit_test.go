@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAbandonedWaits(t *testing.T) {
+	limiter := newHostLimiter(&RateLimitConfig{MaxRequestsPerSecond: 1, Burst: 1})
+	if err := limiter.wait(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// waits given up on don't keep their tokens
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := limiter.wait(ctx, "example.com"); err == nil {
+			t.Fatal("wait within the rate limit's delay succeeded")
+		}
+		cancel()
+	}
+	if delay := limiter.bucket("example.com").reserve(); delay > time.Second {
+		t.Errorf("delay %s after abandoned waits, want at most 1s", delay)
+	}
+
+	// refilled buckets unused for a while are dropped
+	bucket := limiter.bucket("example.com")
+	bucket.last = bucket.last.Add(-2 * limiterIdleTimeout)
+	limiter.mu.Lock()
+	limiter.prune(time.Now())
+	remaining := len(limiter.buckets)
+	limiter.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d buckets left after pruning", remaining)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Minimal RESP client, enough for the Redis sink and the session store
+*/
+
+const redisTimeout = 10 * time.Second
+
+type redisClient struct {
+	target *url.URL
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(rawUrl string) (*redisClient, error) {
+	target, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if target.Scheme != "redis" && target.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis url must start with redis:// or rediss://")
+	}
+	return &redisClient{target: target}, nil
+}
+
+// do runs a command, returning its reply and whether the reply was nil.
+// Array replies are not decoded
+func (c *redisClient) do(args ...string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return "", false, err
+		}
+	}
+	reply, isNil, err := c.roundTrip(args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			// the connection is in an unknown state, reconnect on the next command
+			c.closeLocked()
+		}
+	}
+	return reply, isNil, err
+}
+
+func (c *redisClient) connect() error {
+	conn, err := dialSink(c.target, "6379", c.target.Scheme == "rediss")
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	if password, ok := c.target.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if username := c.target.User.Username(); username != "" {
+			args = []string{"AUTH", username, password}
+		}
+		if _, _, err := c.roundTrip(args...); err != nil {
+			c.closeLocked()
+			return err
+		}
+	}
+	if db := strings.Trim(c.target.Path, "/"); db != "" && db != "0" {
+		if _, _, err := c.roundTrip("SELECT", db); err != nil {
+			c.closeLocked()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) roundTrip(args ...string) (string, bool, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return "", false, err
+	}
+	return c.readReply()
+}
+
+func (c *redisClient) readReply() (string, bool, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", false, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], false, nil
+	case '-':
+		return "", false, redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if size < 0 {
+			return "", true, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return "", false, err
+		}
+		return string(data[:size]), false, nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		for i := 0; i < count; i++ {
+			if _, _, err := c.readReply(); err != nil {
+				return "", false, err
+			}
+		}
+		return "", count < 0, nil
+	}
+	return "", false, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+func (c *redisClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *redisClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// redisError is an error reply, the connection stays usable after it
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+Custom DNS resolution: static host overrides, plain DNS servers and DNS-over-HTTPS
+*/
+
+type ResolverConfig struct {
+	// DNS servers to query instead of the system resolver, e.g. "1.1.1.1" or "8.8.8.8:53"
+	Servers []string `json:"servers"`
+	// RFC 8484 DNS-over-HTTPS endpoint, e.g. "https://cloudflare-dns.com/dns-query"
+	DohUrl string `json:"dohUrl"`
+	// static host to IP overrides, checked before any lookup
+	Hosts map[string]string `json:"hosts"`
+}
+
+const (
+	defaultDnsCacheTtl = time.Minute
+	maxDnsCacheTtl     = 5 * time.Minute
+)
+
+var dohClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	resolversLock sync.Mutex
+	// every resolver created, so their caches can be flushed together
+	resolvers []*resolver
+)
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+type resolver struct {
+	config      ResolverConfig
+	netResolver *net.Resolver
+	cacheLock   sync.Mutex
+	cache       map[string]dnsCacheEntry
+}
+
+func newResolver(config ResolverConfig) *resolver {
+	r := &resolver{
+		config: config,
+		cache:  make(map[string]dnsCacheEntry),
+	}
+	if len(config.Servers) > 0 {
+		servers := make([]string, len(config.Servers))
+		for i, server := range config.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers[i] = server
+		}
+		var next int
+		var nextLock sync.Mutex
+		r.netResolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				// rotate through the configured servers
+				nextLock.Lock()
+				server := servers[next%len(servers)]
+				next++
+				nextLock.Unlock()
+
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	} else {
+		r.netResolver = net.DefaultResolver
+	}
+
+	resolversLock.Lock()
+	resolvers = append(resolvers, r)
+	resolversLock.Unlock()
+	return r
+}
+
+// removeResolver forgets a resolver that is no longer used
+func removeResolver(r *resolver) {
+	resolversLock.Lock()
+	defer resolversLock.Unlock()
+	for i, other := range resolvers {
+		if other == r {
+			resolvers = append(resolvers[:i], resolvers[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookup resolves host to a list of IPs using the configured resolution path
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for name, address := range r.config.Hosts {
+		if strings.EqualFold(name, host) {
+			if ip := net.ParseIP(address); ip != nil {
+				return []net.IP{ip}, nil
+			}
+			// overrides may also point to another hostname
+			host = strings.ToLower(address)
+			break
+		}
+	}
+
+	r.cacheLock.Lock()
+	entry, ok := r.cache[host]
+	r.cacheLock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if r.config.DohUrl != "" {
+		ips, ttl, err = r.lookupDoh(ctx, host)
+	} else {
+		ips, err = r.netResolver.LookupIP(ctx, "ip", host)
+		ttl = defaultDnsCacheTtl
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s: no addresses found", host)
+	}
+
+	r.cacheLock.Lock()
+	r.cache[host] = dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+	r.cacheLock.Unlock()
+	return ips, nil
+}
+
+// flush empties the cache, returning the number of entries dropped
+func (r *resolver) flush() int {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	flushed := len(r.cache)
+	r.cache = make(map[string]dnsCacheEntry)
+	return flushed
+}
+
+// flushResolvers empties the cache of every resolver
+func flushResolvers() int {
+	resolversLock.Lock()
+	defer resolversLock.Unlock()
+	flushed := 0
+	for _, r := range resolvers {
+		flushed += r.flush()
+	}
+	return flushed
+}
+
+func (r *resolver) lookupDoh(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	ttl := maxDnsCacheTtl
+	var lastErr error
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, answerTtl, err := r.queryDoh(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips = append(ips, answers...)
+		if len(answers) > 0 && answerTtl < ttl {
+			ttl = answerTtl
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+func (r *resolver) queryDoh(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.DohUrl, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("invalid DoH response: %w", err)
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DoH server returned %s", reply.RCode)
+	}
+
+	var ips []net.IP
+	ttl := maxDnsCacheTtl
+	for _, answer := range reply.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if answerTtl := time.Duration(answer.Header.TTL) * time.Second; answerTtl < ttl {
+			ttl = answerTtl
+		}
+	}
+	return ips, ttl, nil
+}
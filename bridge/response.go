@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	"github.com/google/uuid"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+/*
+Builds the response sent back to the Python client
+*/
+
+// Response extends the tls-client response with bridge specific fields
+type Response struct {
+	tls_client_cffi.Response
+	// charset the body was decoded from before being transcoded to UTF-8
+	Charset string `json:"charset,omitempty"`
+	// headers whose values were not valid UTF-8, mapped to how they were encoded ("latin1" or "base64")
+	EncodedHeaders map[string]string `json:"encodedHeaders,omitempty"`
+	// headers as [name, value] pairs in the order and casing sent, set with orderedHeaders. Values are encoded like in Headers
+	HeaderList [][2]string `json:"headerList,omitempty"`
+	// "wire" when HeaderList was read off the connection, "unavailable" when the order couldn't be
+	// observed, as for https targets, and HeaderList is left out
+	HeaderListSource string `json:"headerListSource,omitempty"`
+	// digest the body was verified against, "algorithm=base64"
+	Digest string `json:"digest,omitempty"`
+	// a byte order mark was removed from the body
+	BomStripped bool `json:"bomStripped,omitempty"`
+	// cookies set by this response's Set-Cookie headers only
+	ResponseCookies map[string]string `json:"responseCookies"`
+	// every cookie the jar holds for the target url after this response, same as Cookies
+	JarCookies map[string]string `json:"jarCookies"`
+	// parts of a multipart/byteranges response, sorted by offset
+	Ranges []*ByteRange `json:"ranges,omitempty"`
+	// the parts covered one contiguous span and were joined into Body
+	RangesJoined bool `json:"rangesJoined,omitempty"`
+	// remote address, TLS parameters and certificate chain of the connection the response came in on
+	Connection *ConnectionInfo `json:"connection,omitempty"`
+	// set when the session was evicted ("ttl" or "lru") since its last request.
+	// It then started over empty, unless it was restored from the session store
+	SessionEvicted string `json:"sessionEvicted,omitempty"`
+	// first and last bytes, length and digest of the body, set instead of Body when bodySample was given
+	BodySample *BodySample `json:"bodySample,omitempty"`
+	// where the body was kept, set instead of Body when storeBody was given
+	StoredBody *StoredBody `json:"storedBody,omitempty"`
+	// id of the bridge instance owning the session, pass it back as affinity
+	Affinity string `json:"affinity,omitempty"`
+	// set when the request failed, Status is then 0 and Body holds the message
+	Error *ResponseError `json:"error,omitempty"`
+}
+
+// ResponseTooLargeError is returned when a body exceeds maxResponseBytes
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response too large: body exceeds maxResponseBytes of %d bytes", e.Limit)
+}
+
+// maxBytesReader fails with a ResponseTooLargeError once more than limit bytes were read
+type maxBytesReader struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	if int64(n) > m.remaining {
+		n = int(m.remaining)
+		m.remaining = 0
+		return n, &ResponseTooLargeError{Limit: m.limit}
+	}
+	m.remaining -= int64(n)
+	return n, err
+}
+
+func getMaxResponseBytes(requestInput *ExtendedRequestInput) int64 {
+	if requestInput.MaxResponseBytes > 0 {
+		return requestInput.MaxResponseBytes
+	}
+	return getServerConfig().MaxResponseBytes
+}
+
+// buildResponse mirrors tls_client_cffi.BuildResponse, decoding the body to UTF-8 along the way
+func buildResponse(sessionId string, withSession bool, resp *http.Response, cookies []*http.Cookie, requestInput *ExtendedRequestInput) (Response, error) {
+	defer resp.Body.Close()
+
+	input := requestInput.RequestInput
+	ce := resp.Header.Get("Content-Encoding")
+
+	var respBodyBytes []byte
+	var err error
+
+	// header digests cover the body as sent, the caller's digest covers the decoded body
+	var headerCheck, expectedCheck *digestCheck
+	if requestInput.VerifyDigest {
+		headerCheck = headerDigestCheck(resp.Header)
+	}
+	if requestInput.ExpectedDigest != "" {
+		expectedCheck, err = parseExpectedDigest(requestInput.ExpectedDigest)
+		if err != nil {
+			return Response{}, err
+		}
+	}
+
+	if headerCheck != nil && !resp.Uncompressed {
+		resp.Body = headerCheck.hashBody(resp.Body)
+	}
+	if !resp.Uncompressed {
+		resp.Body = http.DecompressBodyByType(resp.Body, ce)
+	} else if headerCheck != nil {
+		resp.Body = headerCheck.hashBody(resp.Body)
+	}
+	if expectedCheck != nil {
+		resp.Body = expectedCheck.hashBody(resp.Body)
+	}
+
+	if limit := getMaxResponseBytes(requestInput); limit > 0 {
+		// refuse early when the server announces an oversized body
+		if resp.ContentLength > limit && ce == "" {
+			return Response{}, &ResponseTooLargeError{Limit: limit}
+		}
+		resp.Body = &maxBytesReader{ReadCloser: resp.Body, limit: limit, remaining: limit}
+	}
+
+	var sample *BodySample
+	if requestInput.BodySample != nil {
+		sample, err = sampleBody(resp.Body, requestInput.BodySample, resp.Header.Get("Content-Type"), input.IsByteResponse)
+	} else if input.StreamOutputPath != nil {
+		respBodyBytes, err = readAllBodyWithStreamToFile(resp.Body, input)
+	} else {
+		respBodyBytes, err = io.ReadAll(resp.Body)
+	}
+
+	if err != nil {
+		return Response{}, err
+	}
+
+	var verifiedDigest string
+	for _, check := range []*digestCheck{headerCheck, expectedCheck} {
+		if check == nil {
+			continue
+		}
+		if err := check.verify(); err != nil {
+			return Response{}, err
+		}
+		verifiedDigest = check.digest()
+	}
+
+	response := Response{
+		Response: tls_client_cffi.Response{
+			Id:           uuid.New().String(),
+			Status:       resp.StatusCode,
+			UsedProtocol: resp.Proto,
+			Target:       "",
+			Cookies:      cookiesToMap(cookies),
+		},
+	}
+	response.Digest = verifiedDigest
+	response.ResponseCookies = cookiesToMap(resp.Cookies())
+	response.JarCookies = response.Cookies
+	response.Headers, response.EncodedHeaders = sanitizeHeaders(resp.Header, requestInput.InvalidHeaderMode)
+
+	contentType := resp.Header.Get("Content-Type")
+	if sample != nil {
+		// the body was never held in full, Body stays empty
+		response.BodySample = sample
+	} else {
+		if resp.StatusCode == http.StatusPartialContent {
+			ranges, err := parseByteRanges(respBodyBytes, contentType)
+			if err != nil {
+				return Response{}, err
+			}
+			if joined, ok := joinByteRanges(ranges); ok {
+				// a single span reads like a plain 206 response
+				respBodyBytes, contentType = joined, ranges[0].ContentType
+				response.RangesJoined = true
+			} else {
+				encodeByteRanges(ranges, input.IsByteResponse)
+			}
+			response.Ranges = ranges
+		}
+		if requestInput.StoreBody {
+			// Body stays empty, the client reads slices of it from /body/{id}
+			response.StoredBody, err = storedBodies.put(response.Id, respBodyBytes, contentType)
+			if err != nil {
+				return Response{}, err
+			}
+		} else if body, name, stripped, ok := normalizeEncoding(respBodyBytes, contentType, requestInput.NormalizeEncoding); ok {
+			response.Body, response.Charset, response.BomStripped = body, name, stripped
+		} else if input.IsByteResponse {
+			mimeType := http.DetectContentType(respBodyBytes)
+			response.Body = fmt.Sprintf("data:%s;base64,", mimeType) + base64.StdEncoding.EncodeToString(respBodyBytes)
+		} else {
+			response.Body, response.Charset = decodeBody(respBodyBytes, contentType)
+		}
+	}
+
+	if resp.Request != nil && resp.Request.URL != nil {
+		response.Target = resp.Request.URL.String()
+	}
+
+	if withSession {
+		response.SessionId = sessionId
+	}
+
+	return response, nil
+}
+
+func readAllBodyWithStreamToFile(respBody io.ReadCloser, input tls_client_cffi.RequestInput) ([]byte, error) {
+	var respBodyBytes []byte
+
+	f, err := os.OpenFile(*input.StreamOutputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blockSize := 1024 // 1 KB
+	if input.StreamOutputBlockSize != nil {
+		blockSize = *input.StreamOutputBlockSize
+	}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := respBody.Read(buf)
+		if n > 0 {
+			respBodyBytes = append(respBodyBytes, buf[:n]...)
+			if _, err := f.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			if input.StreamOutputEOFSymbol != nil {
+				f.Write([]byte(*input.StreamOutputEOFSymbol))
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return respBodyBytes, nil
+}
+
+func cookiesToMap(cookies []*http.Cookie) map[string]string {
+	ret := make(map[string]string, 0)
+
+	for _, c := range cookies {
+		ret[c.Name] = c.Value
+	}
+
+	return ret
+}
+
+var byteOrderMarks = []struct {
+	bom  []byte
+	name string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+	{[]byte{0xff, 0xfe}, "utf-16le"},
+	{[]byte{0xfe, 0xff}, "utf-16be"},
+}
+
+// normalizeEncoding strips a leading byte order mark and transcodes the rest of the body to UTF-8.
+// UTF-16 bodies declared by the Content-Type charset are transcoded as well.
+// Returns the body, the charset it was decoded from, whether a BOM was stripped and whether anything was normalized
+func normalizeEncoding(body []byte, contentType string, enabled bool) (string, string, bool, bool) {
+	if !enabled {
+		return "", "", false, false
+	}
+	name, stripped := "", false
+	for _, mark := range byteOrderMarks {
+		if bytes.HasPrefix(body, mark.bom) {
+			body, name, stripped = body[len(mark.bom):], mark.name, true
+			break
+		}
+	}
+	if name == "" {
+		_, params, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.HasPrefix(strings.ToLower(params["charset"]), "utf-16") {
+			return "", "", false, false
+		}
+		name = strings.ToLower(params["charset"])
+		if name == "utf-16" {
+			// without a BOM, UTF-16 defaults to big endian
+			name = "utf-16be"
+		}
+	}
+	if name == "utf-8" {
+		return string(body), name, stripped, true
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return "", "", false, false
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", "", false, false
+	}
+	return string(decoded), name, stripped, true
+}
+
+// multi-byte charsets tried, in order of preference, when a body declares nothing and isn't UTF-8
+var charsetCandidates = []string{"shift_jis", "euc-jp", "gbk", "big5", "euc-kr"}
+
+// decodeBody transcodes a text body to UTF-8, returning it along with the charset it was decoded from.
+// The charset is taken from the BOM, the Content-Type header or a <meta> tag, and guessed otherwise
+func decodeBody(body []byte, contentType string) (string, string) {
+	if len(body) == 0 || !isTextContentType(contentType) {
+		return string(body), ""
+	}
+
+	enc, name, certain := charset.DetermineEncoding(body, contentType)
+	if !certain && name == "windows-1252" {
+		// undeclared bodies default to windows-1252, prefer UTF-8 when it fits. A charset found
+		// in a <meta> tag is reported as uncertain too, and used as declared
+		if utf8.Valid(body) {
+			return string(body), "utf-8"
+		}
+		name = guessCharset(body)
+		enc, _ = htmlindex.Get(name)
+	}
+	if name == "utf-8" || enc == nil {
+		return string(body), name
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return string(body), ""
+	}
+	return string(decoded), name
+}
+
+// guessCharset picks the candidate charset producing the fewest invalid characters
+func guessCharset(body []byte) string {
+	best := "windows-1252"
+	bestErrors := len(body)/100 + 1
+	for _, name := range charsetCandidates {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			continue
+		}
+		decoded, err := enc.NewDecoder().Bytes(body)
+		if err != nil {
+			continue
+		}
+		if errors := bytes.Count(decoded, []byte(string(utf8.RuneError))); errors < bestErrors {
+			best, bestErrors = name, errors
+		}
+	}
+	return best
+}
+
+func isTextContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, suffix := range []string{"json", "xml", "javascript", "ecmascript", "x-www-form-urlencoded"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeHeaders re-encodes header values that aren't valid UTF-8, which would otherwise be mangled when marshaled.
+// Values are read as latin1 by default, or base64 encoded when mode is "base64"
+func sanitizeHeaders(headers http.Header, mode string) (http.Header, map[string]string) {
+	var encoded map[string]string
+	for name, values := range headers {
+		for _, value := range values {
+			if !utf8.ValidString(value) {
+				if encoded == nil {
+					encoded = make(map[string]string)
+				}
+				encoded[name] = "latin1"
+				if mode == "base64" {
+					encoded[name] = "base64"
+				}
+				break
+			}
+		}
+	}
+	if encoded == nil {
+		return headers, nil
+	}
+
+	sanitized := make(http.Header, len(headers))
+	for name, values := range headers {
+		encoding, ok := encoded[name]
+		if !ok {
+			sanitized[name] = values
+			continue
+		}
+		converted := make([]string, len(values))
+		for i, value := range values {
+			if encoding == "base64" {
+				converted[i] = base64.StdEncoding.EncodeToString([]byte(value))
+			} else {
+				converted[i] = latin1ToUtf8(value)
+			}
+		}
+		sanitized[name] = converted
+	}
+	return sanitized, encoded
+}
+
+func latin1ToUtf8(value string) string {
+	runes := make([]rune, len(value))
+	for i := 0; i < len(value); i++ {
+		runes[i] = rune(value[i])
+	}
+	return string(runes)
+}
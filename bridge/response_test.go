@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestDecodeBodyMetaCharset(t *testing.T) {
+	text, err := charmap.KOI8R.NewEncoder().String("Привет, мир")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`<html><head><meta charset="koi8-r"></head><body>` + text + `</body></html>`)
+	decoded, name := decodeBody(body, "text/html")
+	if name != "koi8-r" || !strings.Contains(decoded, "Привет, мир") {
+		t.Errorf("decoded as %s: %q", name, decoded)
+	}
+}
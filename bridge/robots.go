@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+/*
+Crawl-delay and Request-rate directives from robots.txt, fed into a per-host limiter
+*/
+
+const (
+	robotsCacheTtl     = time.Hour
+	robotsFetchTimeout = 10 * time.Second
+	maxRobotsBytes     = 512 * 1024
+)
+
+type robotsEntry struct {
+	ready   chan struct{}
+	delay   time.Duration
+	fetched time.Time
+}
+
+var (
+	robotsLock  sync.Mutex
+	robotsCache = make(map[string]*robotsEntry)
+	// paces hosts according to their robots.txt, independent of the configured rate limits
+	robotsLimiter = buildHostLimiter(RateLimitConfig{Burst: 1})
+)
+
+func useRobots(requestInput *ExtendedRequestInput) bool {
+	return requestInput.RespectRobots || getServerConfig().RespectRobots
+}
+
+// waitForRobots paces the request to target according to the host's robots.txt
+func waitForRobots(ctx context.Context, client tls_client.HttpClient, target *url.URL, userAgent string) error {
+	delay := getRobotsDelay(ctx, client, target, userAgent)
+	if delay <= 0 {
+		return nil
+	}
+	host := target.Hostname()
+	robotsLimiter.setHostRate(host, float64(time.Second)/float64(delay))
+	return robotsLimiter.wait(ctx, host)
+}
+
+// getRobotsDelay returns the delay asked for by the host, fetching robots.txt at most once per cache period
+func getRobotsDelay(ctx context.Context, client tls_client.HttpClient, target *url.URL, userAgent string) time.Duration {
+	key := target.Scheme + "://" + target.Host + "\x00" + userAgent
+
+	robotsLock.Lock()
+	entry, ok := robotsCache[key]
+	if !ok || (isClosed(entry.ready) && time.Since(entry.fetched) > robotsCacheTtl) {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		robotsCache[key] = entry
+		robotsLock.Unlock()
+
+		delay, fetched := fetchRobotsDelay(ctx, client, target, userAgent)
+		entry.delay, entry.fetched = delay, time.Now()
+		if !fetched {
+			// only an answer from the host is cached, a canceled or failed fetch is tried again
+			robotsLock.Lock()
+			if robotsCache[key] == entry {
+				delete(robotsCache, key)
+			}
+			robotsLock.Unlock()
+		}
+		close(entry.ready)
+		return entry.delay
+	}
+	robotsLock.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.delay
+	case <-ctx.Done():
+		return 0
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetchRobotsDelay returns the delay asked for by the host's robots.txt, and whether the host answered
+func fetchRobotsDelay(ctx context.Context, client tls_client.HttpClient, target *url.URL, userAgent string) (time.Duration, bool) {
+	ctx, cancel := context.WithTimeout(ctx, robotsFetchTimeout)
+	defer cancel()
+
+	robotsUrl := url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsUrl.String(), nil)
+	if err != nil {
+		return 0, false
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, true
+	}
+	body := http.DecompressBodyByType(resp.Body, resp.Header.Get("Content-Encoding"))
+	return parseRobotsDelay(io.LimitReader(body, maxRobotsBytes), userAgent), true
+}
+
+// parseRobotsDelay reads the Crawl-delay and Request-rate of the group matching userAgent, falling back to "*".
+// The stricter of the two wins
+func parseRobotsDelay(r io.Reader, userAgent string) time.Duration {
+	agent := strings.ToLower(userAgent)
+	var matched, wildcard time.Duration
+	var foundMatched bool
+
+	var groupAgents []string
+	inRules := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			// a user-agent line after rules starts a new group
+			if inRules {
+				groupAgents = nil
+				inRules = false
+			}
+			groupAgents = append(groupAgents, strings.ToLower(value))
+			continue
+		}
+		inRules = true
+
+		var delay time.Duration
+		switch key {
+		case "crawl-delay":
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(seconds > 0 && seconds < math.MaxInt64/float64(time.Second)) {
+				continue
+			}
+			delay = time.Duration(seconds * float64(time.Second))
+		case "request-rate":
+			delay = parseRequestRate(value)
+		default:
+			continue
+		}
+
+		for _, groupAgent := range groupAgents {
+			if groupAgent == "*" {
+				wildcard = max(wildcard, delay)
+			} else if agent != "" && strings.Contains(agent, groupAgent) {
+				matched = max(matched, delay)
+				foundMatched = true
+			}
+		}
+	}
+	if foundMatched {
+		return matched
+	}
+	return wildcard
+}
+
+// parseRequestRate turns "requests/period" with an optional s, m or h unit into a delay between requests,
+// or 0 for a malformed value
+func parseRequestRate(value string) time.Duration {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0
+	}
+	rawRequests, rawPeriod, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return 0
+	}
+	requests, err := strconv.ParseFloat(rawRequests, 64)
+	if err != nil || requests <= 0 {
+		return 0
+	}
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(rawPeriod, "m"):
+		unit = time.Minute
+	case strings.HasSuffix(rawPeriod, "h"):
+		unit = time.Hour
+	}
+	period, err := strconv.ParseFloat(strings.TrimRight(rawPeriod, "smh"), 64)
+	if err != nil || !(period > 0) {
+		return 0
+	}
+	delay := period / requests * float64(unit)
+	if delay >= math.MaxInt64 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+// flushRobots forgets every cached robots.txt, returning the number of entries dropped
+func flushRobots() int {
+	robotsLock.Lock()
+	defer robotsLock.Unlock()
+	flushed := len(robotsCache)
+	robotsCache = make(map[string]*robotsEntry)
+	return flushed
+}
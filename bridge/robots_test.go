@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+func TestParseRobotsDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		robots string
+		agent  string
+		want   time.Duration
+	}{
+		{"crawl delay", "User-agent: *\nCrawl-delay: 2", "bot", 2 * time.Second},
+		{"fractional crawl delay", "User-agent: *\nCrawl-delay: 0.5", "bot", 500 * time.Millisecond},
+		{"empty crawl delay", "User-agent: *\nCrawl-delay:", "bot", 0},
+		{"garbage crawl delay", "User-agent: *\nCrawl-delay: soon", "bot", 0},
+		{"negative crawl delay", "User-agent: *\nCrawl-delay: -3", "bot", 0},
+		{"huge crawl delay", "User-agent: *\nCrawl-delay: 1e300", "bot", 0},
+		{"request rate", "User-agent: *\nRequest-rate: 1/5", "bot", 5 * time.Second},
+		{"request rate in minutes", "User-agent: *\nRequest-rate: 3/1m", "bot", 20 * time.Second},
+		{"fractional request rate", "User-agent: *\nRequest-rate: 2/0.5s", "bot", 250 * time.Millisecond},
+		{"request rate with a time window", "User-agent: *\nRequest-rate: 1/10s 0900-1700", "bot", 10 * time.Second},
+		{"empty request rate", "User-agent: *\nRequest-rate:", "bot", 0},
+		{"blank request rate", "User-agent: *\nRequest-rate:    ", "bot", 0},
+		{"garbage request rate", "User-agent: *\nRequest-rate: fast", "bot", 0},
+		{"zero request rate", "User-agent: *\nRequest-rate: 0/5", "bot", 0},
+		{"garbage next to a valid line", "User-agent: *\nRequest-rate: x/y\nCrawl-delay: 1", "bot", time.Second},
+		{"stricter directive wins", "User-agent: *\nCrawl-delay: 1\nRequest-rate: 1/4", "bot", 4 * time.Second},
+		{"matching group before wildcard", "User-agent: *\nCrawl-delay: 9\n\nUser-agent: mybot\nCrawl-delay: 1", "MyBot/1.0", time.Second},
+		{"other group ignored", "User-agent: otherbot\nCrawl-delay: 9", "mybot", 0},
+		{"comments", "User-agent: * # all\nCrawl-delay: 3 # slow down", "bot", 3 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseRobotsDelay(strings.NewReader(test.robots), test.agent); got != test.want {
+				t.Errorf("delay %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRobotsFailedFetchIsNotCached(t *testing.T) {
+	client, err := tls_client.NewHttpClient(tls_client.NewNoopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &url.URL{Scheme: "http", Host: "robots.invalid"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if delay := getRobotsDelay(ctx, client, target, "bot"); delay != 0 {
+		t.Errorf("delay %s from a canceled fetch", delay)
+	}
+
+	robotsLock.Lock()
+	_, cached := robotsCache[target.Scheme+"://"+target.Host+"\x00bot"]
+	robotsLock.Unlock()
+	if cached {
+		t.Error("canceled fetch was cached")
+	}
+}
@@ -6,16 +6,21 @@ package main
 import "C"
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unsafe"
 
 	http "github.com/bogdanfinn/fhttp"
 	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
 	json "github.com/goccy/go-json"
-	"github.com/google/uuid"
 )
 
 /*
@@ -24,9 +29,9 @@ Offers a http server that can be used to make requests to tls-client
 
 type ResponseWrapper struct {
 	// wrapper for multirequest return type
-	IsHistory bool                        `json:"isHistory"`
-	Response  *tls_client_cffi.Response   `json:"response,omitempty"`
-	History   []*tls_client_cffi.Response `json:"history,omitempty"`
+	IsHistory bool        `json:"isHistory"`
+	Response  *Response   `json:"response,omitempty"`
+	History   []*Response `json:"history,omitempty"`
 }
 
 type IndexedResponseWrapper struct {
@@ -36,7 +41,60 @@ type IndexedResponseWrapper struct {
 
 type ExtendedRequestInput struct {
 	tls_client_cffi.RequestInput
-	WantHistory bool `json:"wantHistory"`
+	// replaces RequestInput.RequestCookies, keeping all cookie attributes
+	RequestCookies []Cookie         `json:"requestCookies"`
+	WantHistory    bool             `json:"wantHistory"`
+	RateLimit      *RateLimitConfig `json:"rateLimit"`
+	CompatMode     bool             `json:"compatMode"`
+	Resolver       *ResolverConfig  `json:"resolver"`
+	// proxies traversed before proxyUrl, e.g. ["socks5://corp:1080"]
+	ProxyChain []string `json:"proxyChain"`
+	// upper bound on the total time spent on the request, including redirects
+	BudgetMs int `json:"budgetMs"`
+	// like budgetMs, but failing with a timeout error and defaulting to the server's timeoutMs.
+	// Unlike timeoutMilliseconds it applies per request, also to sessions created with another timeout
+	TimeoutMs int `json:"timeoutMs"`
+	// fail when no data moves for this long, counted from sending the request and per redirect hop with wantHistory
+	ReadTimeoutMs int `json:"readTimeoutMs"`
+	// abort reading bodies larger than this many bytes after decompression
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+	// how header values that aren't valid UTF-8 are returned: "latin1" (default) or "base64"
+	InvalidHeaderMode string `json:"invalidHeaderMode"`
+	// pace requests by the Crawl-delay and Request-rate found in the host's robots.txt
+	RespectRobots bool `json:"respectRobots"`
+	// report upload and download progress under this id, see /progress/{id}
+	ProgressId string `json:"progressId"`
+	// verify the body against this digest, "sha-256=<base64>" or "sha256:<hex>"
+	ExpectedDigest string `json:"expectedDigest"`
+	// verify the body against the Repr-Digest, Digest or Content-MD5 header sent by the server
+	VerifyDigest bool `json:"verifyDigest"`
+	// strip byte order marks and transcode UTF-16 bodies to UTF-8, even for byte responses and binary content types
+	NormalizeEncoding bool `json:"normalizeEncoding"`
+	// turn HAR recording of the session (or of sessionless requests) on or off, see /har/export
+	RecordHar *bool `json:"recordHar"`
+	// replay a share of requests against a secondary target, proxy or profile
+	Mirror *MirrorConfig `json:"mirror"`
+	// custom JA3 and HTTP/2 fingerprint, replacing tlsClientIdentifier and customTlsClient
+	Fingerprint *FingerprintInput `json:"fingerprint"`
+	// address family and source address of outgoing connections, kept for the session
+	Dial *DialOptions `json:"dial"`
+	// return only the first and last bytes of the body, with its length and digest
+	BodySample *BodySampleInput `json:"bodySample"`
+	// keep the decompressed body on the bridge instead of returning it, see /body/{id}
+	StoreBody bool `json:"storeBody"`
+	// download large GET bodies as byte ranges in parallel when the server answers Range requests
+	ParallelRanges *ParallelRangesInput `json:"parallelRanges"`
+	// compress the request body with "gzip", "br" or "zstd" and send it with a matching Content-Encoding
+	CompressRequestBody string `json:"compressRequestBody"`
+	// also return the headers as an ordered [name, value] list, only available for http:// targets
+	OrderedHeaders bool `json:"orderedHeaders"`
+	// affinity token of the bridge instance owning the session, see ClusterConfig
+	Affinity string `json:"affinity"`
+
+	// set once a 407 was answered by retrying through the dial shim
+	proxyAuthRetry bool
+	// shadow copy sent by startMirror
+	isMirror bool
 }
 
 func extractBody(w http.ResponseWriter, r *http.Request) []byte {
@@ -62,23 +120,13 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	rawData := extractBody(w, r)
 	// unmarshal the request input as ExtendedRequestInput
 	params := ExtendedRequestInput{}
-	err := json.Unmarshal(rawData, &params)
+	err := decodeJson(r, rawData, &params)
 	if err != nil {
-		http.Error(w, "Invalid JSON format for request", http.StatusBadRequest)
+		http.Error(w, invalidJsonMessage("request", err), http.StatusBadRequest)
 		return
 	}
 	// call the request function and write the response back to the client
-	var jsonResponse []byte
-	if params.WantHistory && params.RequestInput.FollowRedirects {
-		// get full history
-		historyResponses := requestHistory(&params)
-		jsonResponse, err = json.Marshal(ResponseWrapper{History: *historyResponses, IsHistory: true})
-	} else {
-		// get single response
-		response := request(&params)
-		jsonResponse, err = json.Marshal(ResponseWrapper{Response: response, IsHistory: false})
-	}
-
+	jsonResponse, err := json.Marshal(wrapResponse(&params, fetch(r.Context(), &params)))
 	if err != nil {
 		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
 		return
@@ -87,16 +135,63 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func multiRequestHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Runs several requests in parallel. With ?summary=true the results are returned
+		alongside aggregate statistics, keeping the ?slowest= (default 5) slowest entries.
+		With ?stream=true each result is written as an NDJSON line as soon as it completes
+	*/
 	rawData := extractBody(w, r)
 	// unmarshal the request input as []ExtendedRequestInput
 	requests := []ExtendedRequestInput{}
-	err := json.Unmarshal(rawData, &requests)
+	err := decodeJson(r, rawData, &requests)
 	if err != nil {
-		http.Error(w, "Invalid JSON format for multirequest", http.StatusBadRequest)
+		http.Error(w, invalidJsonMessage("multirequest", err), http.StatusBadRequest)
+		return
+	}
+
+	wantSummary, _ := strconv.ParseBool(r.URL.Query().Get("summary"))
+	slowest, err := strconv.Atoi(r.URL.Query().Get("slowest"))
+	if err != nil || slowest < 0 {
+		slowest = defaultSlowestEntries
+	}
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		streamMultiRequest(w, r, requests, wantSummary, slowest)
 		return
 	}
 
-	results := make([]*ResponseWrapper, len(requests))
+	results := make([]any, len(requests))
+	wrappers := make([]*ResponseWrapper, len(requests))
+	durations := make([]time.Duration, len(requests))
+	start := time.Now()
+
+	// Collect results from the channel
+	for indexedWrapper := range runBatch(r.Context(), requests, durations) {
+		wrappers[indexedWrapper.int] = indexedWrapper.ResponseWrapper
+		results[indexedWrapper.int] = wrapResponse(&requests[indexedWrapper.int], indexedWrapper.ResponseWrapper)
+	}
+
+	var output any = results
+	if wantSummary {
+		output = MultiRequestOutput{
+			Results: results,
+			Summary: summarizeBatch(requests, wrappers, durations, time.Since(start), slowest),
+		}
+	}
+
+	// Marshal the results into a JSON array
+	resultsJson, err := json.Marshal(output)
+	if err != nil {
+		http.Error(w, "Failed to marshal results", http.StatusInternalServerError)
+		return
+	}
+
+	// Write the response back to the client
+	w.Write(resultsJson)
+}
+
+// runBatch fetches every request in parallel, sending each result on the returned channel as it completes.
+// The time taken by each request is stored in durations, the channel is closed once all are done
+func runBatch(ctx context.Context, requests []ExtendedRequestInput, durations []time.Duration) <-chan *IndexedResponseWrapper {
 	resultsCh := make(chan *IndexedResponseWrapper, len(requests))
 	var wg sync.WaitGroup
 
@@ -105,19 +200,10 @@ func multiRequestHandler(w http.ResponseWriter, r *http.Request) {
 		wg.Add(1)
 		go func(i int, param_ptr *ExtendedRequestInput) {
 			defer wg.Done()
-			var resWrapper *ResponseWrapper
-			if param_ptr.WantHistory && param_ptr.RequestInput.FollowRedirects {
-				resWrapper = &ResponseWrapper{
-					IsHistory: true,
-					History:   *requestHistory(param_ptr),
-				}
-			} else {
-				resWrapper = &ResponseWrapper{
-					IsHistory: false,
-					Response:  request(param_ptr),
-				}
-			}
-			resultsCh <- &IndexedResponseWrapper{i, resWrapper}
+			requestStart := time.Now()
+			wrapper := fetch(ctx, param_ptr)
+			durations[i] = time.Since(requestStart)
+			resultsCh <- &IndexedResponseWrapper{i, wrapper}
 		}(idx, &param_ptr)
 	}
 
@@ -126,21 +212,69 @@ func multiRequestHandler(w http.ResponseWriter, r *http.Request) {
 		wg.Wait()
 		close(resultsCh)
 	}()
+	return resultsCh
+}
 
-	// Collect results from the channel
-	for indexedWrapper := range resultsCh {
-		results[indexedWrapper.int] = indexedWrapper.ResponseWrapper
+// fetch runs a request, following the redirect history if wanted
+func fetch(ctx context.Context, params *ExtendedRequestInput) *ResponseWrapper {
+	ctx, cancel := requestContext(ctx, params)
+	defer cancel()
+
+	if peer, err := ownerPeer(params); err != nil {
+		sessionId, withSession := inputSessionId(params)
+		return &ResponseWrapper{Response: handleErrorResponse(sessionId, withSession, phaseSetup, err)}
+	} else if peer != "" {
+		return forwardToPeer(ctx, peer, params)
 	}
 
-	// Marshal the results into a JSON array
-	resultsJson, err := json.Marshal(results)
-	if err != nil {
-		http.Error(w, "Failed to marshal results", http.StatusInternalServerError)
-		return
+	sessionId, withSession := inputSessionId(params)
+	evicted := ""
+	if withSession {
+		if err := loadStoredSession(sessionId); err != nil {
+			return &ResponseWrapper{Response: handleErrorResponse(sessionId, withSession, phaseSetup, fmt.Errorf("failed to load session from store: %w", err))}
+		}
+		evicted = takeEviction(sessionId)
+		release := getSession(sessionId).touch()
+		defer release()
 	}
 
-	// Write the response back to the client
-	w.Write(resultsJson)
+	var tracker *progressTracker
+	if params.ProgressId != "" {
+		tracker = startProgress(params.ProgressId)
+	}
+	finishMirror := startMirror(params)
+
+	var wrapper *ResponseWrapper
+	if params.WantHistory && params.RequestInput.FollowRedirects {
+		// get full history
+		wrapper = &ResponseWrapper{IsHistory: true, History: *requestHistory(ctx, params)}
+	} else {
+		// get single response
+		wrapper = &ResponseWrapper{IsHistory: false, Response: request(ctx, params)}
+	}
+
+	final := wrapper.Response
+	if wrapper.IsHistory && len(wrapper.History) > 0 {
+		final = wrapper.History[len(wrapper.History)-1]
+	}
+	if final != nil {
+		final.SessionEvicted = evicted
+	}
+	if withSession {
+		// the response is already complete, a failed save only costs other instances the latest cookies
+		saveStoredSession(sessionId)
+	}
+	setAffinity(wrapper)
+	finishMirror(final)
+	publishToSinks(wrapResponse(params, wrapper))
+	if tracker != nil {
+		errorMessage := ""
+		if final != nil && final.Status == 0 {
+			errorMessage = final.Body
+		}
+		tracker.finish(errorMessage)
+	}
+	return wrapper
 }
 
 func pingHandler(w http.ResponseWriter, r *http.Request) {
@@ -156,40 +290,142 @@ func main() {
 	*/
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: <program-name> <port-number>")
+		fmt.Println("       <program-name> doctor [<json-options>]")
 		os.Exit(1)
 	}
+	if os.Args[1] == "doctor" {
+		doctorCommand(os.Args[2:])
+		return
+	}
 
 	port := os.Args[1] // port is passed as the first argument
+	// the auth token is read from the environment, or generated if unset
+	token := setAuthToken(os.Getenv("HREQUESTS_BRIDGE_TOKEN"))
 
-	fmt.Printf("Starting server at http://localhost:%s\n", port)
-	startServer(port)
+	listener, err := listen(port)
+	if err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Starting server at http://localhost:%d\n", listener.Addr().(*net.TCPAddr).Port)
+	fmt.Printf("Auth token (%s header): %s\n", authTokenHeader, token)
+	if err := serve(listener); err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
 }
 
-func startServer(port string) {
+var registerHandlersOnce sync.Once
+
+func registerHandlers() {
 	http.HandleFunc("/request", requestHandler)
 	http.HandleFunc("/multirequest", multiRequestHandler)
+	http.HandleFunc("/pipeline", pipelineHandler)
 	http.HandleFunc("/ping", pingHandler)
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
-		os.Exit(1)
+	http.HandleFunc("/config", configHandler)
+	http.HandleFunc("/sessions", sessionsHandler)
+	http.HandleFunc("/sessions/bulk", bulkSessionsHandler)
+	http.HandleFunc("/session/", sessionHandler)
+	http.HandleFunc("/session/restore", sessionRestoreHandler)
+	http.HandleFunc("/progress/", progressHandler)
+	http.HandleFunc("/har/export", harExportHandler)
+	http.HandleFunc("/har/clear", harClearHandler)
+	http.HandleFunc("/maintenance/flush", maintenanceFlushHandler)
+	http.HandleFunc("/mirror/log", mirrorLogHandler)
+	http.HandleFunc("/sinks", sinksHandler)
+	http.HandleFunc("/doctor", doctorHandler)
+	http.HandleFunc("/forwardProxy", forwardProxyHandler)
+	http.HandleFunc("/connect", connectHandler)
+	http.HandleFunc("/capabilities", capabilitiesHandler)
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/body/", bodyHandler)
+	// tls-client CFFI compatible endpoints
+	http.HandleFunc("/destroySession", destroySessionHandler)
+	http.HandleFunc("/destroyAll", destroyAllHandler)
+	http.HandleFunc("/getCookiesFromSession", getCookiesFromSessionHandler)
+	http.HandleFunc("/addCookiesToSession", addCookiesToSessionHandler)
+}
+
+// listen binds the api listener, port "0" picks a free one
+func listen(port string) (net.Listener, error) {
+	// handlers can only be registered once, the server may be restarted after StopServer
+	registerHandlersOnce.Do(registerHandlers)
+	return net.Listen("tcp", ":"+port)
+}
+
+func serve(listener net.Listener) error {
+	return serveApi(startApiServer(listener))
+}
+
+// serveApi blocks until the server started by startApiServer is stopped
+func serveApi(server *http.Server, listener *limitListener) error {
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
+}
+
+type StartServerOutput struct {
+	// port the server is listening on, the one picked when 0 was passed
+	Port  int    `json:"port"`
+	Token string `json:"token"`
+	// set when the listener couldn't be bound, the server isn't running then
+	Error string `json:"error,omitempty"`
 }
 
 //export StartServer
-func StartServer(port string) {
-	// exposed function to start the server in a goroutine
-	go startServer(port)
+func StartServer(port string, token string) *C.char {
+	// exposed function to start the server in a goroutine. port may be "0" to let the OS pick one.
+	// returns a StartServerOutput as JSON with the bound port and the auth token callers must send,
+	// generated if token is empty. free it with FreeMemory
+	output := StartServerOutput{}
+	listener, err := listen(port)
+	if err != nil {
+		output.Error = err.Error()
+	} else {
+		output.Port = listener.Addr().(*net.TCPAddr).Port
+		output.Token = setAuthToken(token)
+		server, limited := startApiServer(listener)
+		go func() {
+			if err := serveApi(server, limited); err != nil {
+				fmt.Printf("Server stopped: %v\n", err)
+			}
+		}()
+	}
+	encoded, _ := json.Marshal(output)
+	return C.CString(string(encoded))
+}
+
+//export FreeMemory
+func FreeMemory(ptr *C.char) {
+	C.free(unsafe.Pointer(ptr))
+}
+
+//export StopServer
+func StopServer() {
+	// closes the server, draining in-flight requests if a drain timeout is configured
+	timeout := time.Duration(getApiServerConfig().ShutdownDrainTimeoutMs) * time.Millisecond
+	stopServer(timeout)
+}
+
+//export StopServerGraceful
+func StopServerGraceful(timeoutMs int) {
+	// waits up to timeoutMs for in-flight requests to complete before closing the server
+	stopServer(time.Duration(timeoutMs) * time.Millisecond)
 }
 
 //export DestroyAll
 func DestroyAll() {
 	tls_client_cffi.ClearSessionCache()
+	clearSessions()
 }
 
 //export DestroySession
 func DestroySession(sessionId string) {
 	tls_client_cffi.RemoveSession(sessionId)
+	removeSession(sessionId)
+	deleteStoredSession(sessionId)
 }
 
 func mergeRelative(srcURL string, redirURL string) (string, error) {
@@ -219,17 +455,17 @@ func mergeRelative(srcURL string, redirURL string) (string, error) {
 	return parsedRed.String(), nil
 }
 
-func requestHistory(requestInput *ExtendedRequestInput) *[]*tls_client_cffi.Response {
+func requestHistory(ctx context.Context, requestInput *ExtendedRequestInput) *[]*Response {
 	// set follow redirects to false
 	requestInput.RequestInput.FollowRedirects = false
 	// create a list of requests
 	// then while the response is a redirect, add the next request to the list
 	// then return the list
-	var requests []*tls_client_cffi.Response
-	var responseJson *tls_client_cffi.Response
+	var requests []*Response
+	var responseJson *Response
 
 	for true {
-		responseJson = request(requestInput)
+		responseJson = request(ctx, requestInput)
 		// add a copy of responseJson to requests
 		requests = append(requests, responseJson)
 
@@ -238,6 +474,9 @@ func requestHistory(requestInput *ExtendedRequestInput) *[]*tls_client_cffi.Resp
 			break
 		}
 		// check the Location header
+		if len(responseJson.Headers["Location"]) == 0 {
+			break
+		}
 		location := responseJson.Headers["Location"][0]
 		// merge the location with the original url
 		newUrl, err := mergeRelative(requestInput.RequestInput.RequestUrl, location)
@@ -256,95 +495,293 @@ func requestHistory(requestInput *ExtendedRequestInput) *[]*tls_client_cffi.Resp
 	return &requests
 }
 
-func request(requestInput *ExtendedRequestInput) *tls_client_cffi.Response {
-	tlsClient, sessionId, withSession, err := tls_client_cffi.CreateClient(requestInput.RequestInput)
+func request(ctx context.Context, requestInput *ExtendedRequestInput) *Response {
+	clientInput, err := buildClientInput(requestInput)
 	if err != nil {
-		return handleErrorResponse(sessionId, withSession, err)
+		sessionId, withSession := inputSessionId(requestInput)
+		return handleErrorResponse(sessionId, withSession, phaseSetup, err)
 	}
 
-	req, err := tls_client_cffi.BuildRequest(requestInput.RequestInput)
+	if sessionId, withSession := inputSessionId(requestInput); withSession && requestInput.Fingerprint != nil {
+		if err := refreshSessionFingerprint(sessionId, clientInput); err != nil {
+			return handleErrorResponse(sessionId, withSession, phaseSetup, err)
+		}
+	}
+
+	tlsClient, sessionId, withSession, err := tls_client_cffi.CreateClient(clientInput)
 	if err != nil {
-		clientErr := tls_client_cffi.NewTLSClientError(err)
+		return handleErrorResponse(sessionId, withSession, phaseSetup, err)
+	}
+	if withSession {
+		getSession(sessionId).initClientInput(clientInput)
+	}
+	installClockJar(tlsClient)
 
-		return handleErrorResponse(sessionId, withSession, clientErr)
+	req, err := tls_client_cffi.BuildRequest(requestInput.RequestInput)
+	if err != nil {
+		return handleErrorResponse(sessionId, withSession, phaseSetup, err)
+	}
+	if requestInput.CompressRequestBody != "" {
+		if err := compressRequestBody(req, requestInput.CompressRequestBody); err != nil {
+			return handleErrorResponse(sessionId, withSession, phaseSetup, err)
+		}
 	}
 
-	cookies := buildCookies(requestInput.RequestInput.RequestCookies)
+	cookies := buildCookies(requestInput.RequestCookies)
 
 	if len(cookies) > 0 {
 		tlsClient.SetCookies(req.URL, cookies)
 	}
 
-	resp, reqErr := tlsClient.Do(req)
+	// ctx stays the parent of the watchdog, the proxy auth retry below gets a fresh one
+	hopCtx, watchdog := newReadWatchdog(ctx, getReadTimeoutMs(requestInput))
+	defer watchdog.stop()
+
+	trace := &connectionTrace{}
+	req = req.WithContext(trace.withContext(hopCtx))
+	localAddr := func() string { return "" }
+	if requestInput.OrderedHeaders {
+		req, localAddr = traceLocalAddr(req)
+	}
+
+	waitErr := getLimiter(requestInput, sessionId, withSession).wait(ctx, req.URL.Hostname())
+	if waitErr != nil {
+		return handleErrorResponse(sessionId, withSession, phaseRateLimit, deadlineError(ctx, waitErr))
+	}
+
+	if useRobots(requestInput) {
+		waitErr = waitForRobots(ctx, tlsClient, req.URL, req.Header.Get("User-Agent"))
+		if waitErr != nil {
+			return handleErrorResponse(sessionId, withSession, phaseRateLimit, deadlineError(ctx, waitErr))
+		}
+	}
+
+	tracker := getProgress(requestInput)
+	if req.Body != nil && req.Body != http.NoBody {
+		tracker.beginPhase("upload", req.ContentLength)
+		req.Body = watchdog.watchBody(tracker.trackBody(req.Body))
+	}
+
+	har := getHarRecorder(requestInput, sessionId, withSession)
+	timer := harTimer{start: time.Now(), startedAt: now()}
+
+	watchdog.start()
+	var resp *http.Response
+	var reqErr error
+	if requestInput.ParallelRanges != nil {
+		resp, reqErr = doInRanges(tlsClient, req, requestInput.ParallelRanges, watchdog)
+	} else {
+		resp, reqErr = tlsClient.Do(req)
+	}
+	timer.headers = time.Now()
+
+	if reqErr != nil && isProxyAuthFailure(reqErr) && !requestInput.proxyAuthRetry && hasProxyCredentials(requestInput.ProxyUrl) {
+		// tls-client only sends Basic auth, retry through the shim which also answers Digest challenges
+		requestInput.proxyAuthRetry = true
+		if withSession {
+			getSession(sessionId).setProxyAuth()
+		}
+		return request(ctx, requestInput)
+	}
 
 	if reqErr != nil {
-		clientErr := tls_client_cffi.NewTLSClientError(fmt.Errorf("failed to do request: %w", reqErr))
+		if shimErr := shimDialError(clientInput.ProxyUrl, req.URL); shimErr != nil {
+			reqErr = shimErr
+		}
+		clientErr := deadlineError(hopCtx, fmt.Errorf("failed to do request: %w", reqErr))
+		if har != nil {
+			entry := newHarEntry(req, requestInput, timer)
+			entry.Error = clientErr.Error()
+			har.add(entry)
+		}
 
-		return handleErrorResponse(sessionId, withSession, clientErr)
+		return handleErrorResponse(sessionId, withSession, phaseRequest, clientErr)
 	}
 
 	if resp == nil {
-		clientErr := tls_client_cffi.NewTLSClientError(fmt.Errorf("response is nil"))
-
-		return handleErrorResponse(sessionId, withSession, clientErr)
+		return handleErrorResponse(sessionId, withSession, phaseRequest, fmt.Errorf("response is nil"))
 	}
 
 	targetCookies := tlsClient.GetCookies(resp.Request.URL)
 
-	response, err := tls_client_cffi.BuildResponse(sessionId, withSession, resp, targetCookies, requestInput.RequestInput)
-	if err != nil {
-		return handleErrorResponse(sessionId, withSession, err)
+	tracker.beginPhase("download", resp.ContentLength)
+	resp.Body = watchdog.watchBody(tracker.trackBody(resp.Body))
+
+	response, buildErr := buildResponse(sessionId, withSession, resp, targetCookies, requestInput)
+	if har != nil {
+		entry := newHarEntry(req, requestInput, timer)
+		if buildErr != nil {
+			entry.Error = buildErr.Error()
+		} else {
+			entry.setResponse(resp, &response)
+		}
+		har.add(entry)
+	}
+	if buildErr != nil {
+		return handleErrorResponse(sessionId, withSession, phaseResponse, deadlineError(hopCtx, buildErr))
+	}
+	response.Connection = trace.info(resp)
+	if requestInput.OrderedHeaders {
+		response.HeaderList, response.HeaderListSource = buildHeaderList(&response, localAddr())
 	}
 
 	return &response
 }
 
-func handleErrorResponse(sessionId string, withSession bool, err *tls_client_cffi.TLSClientError) *tls_client_cffi.Response {
-	response := tls_client_cffi.Response{
-		Id:      uuid.New().String(),
-		Status:  0,
-		Body:    err.Error(),
-		Headers: nil,
-		Cookies: nil,
+func inputSessionId(requestInput *ExtendedRequestInput) (string, bool) {
+	if requestInput.SessionId != nil && *requestInput.SessionId != "" {
+		return *requestInput.SessionId, true
+	}
+	return "", false
+}
+
+// buildClientInput returns the input used to create the tls-client, routing it through a dial shim when needed
+func buildClientInput(requestInput *ExtendedRequestInput) (tls_client_cffi.RequestInput, *tls_client_cffi.TLSClientError) {
+	clientInput := requestInput.RequestInput
+	if requestInput.StoreBody && requestInput.BodySample != nil {
+		return clientInput, tls_client_cffi.NewTLSClientError(fmt.Errorf("storeBody can't be combined with bodySample"))
+	}
+	config := dialConfig{
+		Resolver:   getResolverConfig(requestInput),
+		ProxyChain: requestInput.ProxyChain,
+		ProxyAuth:  requestInput.proxyAuthRetry,
+		Local:      getDialOptions(requestInput),
+		// only plaintext responses can be read on their way through the shim
+		CaptureHeads: capturesHeads(requestInput),
+	}
+	if sessionId, withSession := inputSessionId(requestInput); withSession && getSession(sessionId).getProxyAuth() {
+		config.ProxyAuth = true
+	}
+	if clientInput.ProxyUrl != nil {
+		config.ProxyUrl = *clientInput.ProxyUrl
+	}
+	if err := applyFingerprint(requestInput, &clientInput); err != nil {
+		return clientInput, err
+	}
+	if !config.needsShim() {
+		return clientInput, nil
+	}
+
+	shimUrl, err := getDialShim(config)
+	if err != nil {
+		return clientInput, tls_client_cffi.NewTLSClientError(fmt.Errorf("failed to set up dialer: %w", err))
+	}
+	clientInput.ProxyUrl = &shimUrl
+	return clientInput, nil
+}
+
+func getResolverConfig(requestInput *ExtendedRequestInput) *ResolverConfig {
+	if sessionId, withSession := inputSessionId(requestInput); withSession {
+		session := getSession(sessionId)
+		if requestInput.Resolver != nil {
+			session.setResolver(requestInput.Resolver)
+		}
+		if resolver := session.getResolver(); resolver != nil {
+			return resolver
+		}
+	} else if requestInput.Resolver != nil {
+		return requestInput.Resolver
 	}
+	return getServerConfig().Resolver
+}
 
+func getLimiter(requestInput *ExtendedRequestInput, sessionId string, withSession bool) *hostLimiter {
+	// shadow copies must not use up the tokens of the requests they mirror
+	if requestInput.isMirror {
+		return nil
+	}
+	// session rate limits take priority over the server-wide default
 	if withSession {
-		response.SessionId = sessionId
+		session := getSession(sessionId)
+		if requestInput.RateLimit != nil {
+			session.setRateLimit(requestInput.RateLimit)
+		}
+		if limiter, ok := session.getLimiter(); ok {
+			return limiter
+		}
+	} else if requestInput.RateLimit != nil {
+		// sessionless requests get a one-off limiter shared by requests with the same config
+		return getAdhocLimiter(*requestInput.RateLimit)
 	}
+	return getGlobalLimiter()
+}
 
-	return &response
+// Cookie extends the tls-client cookie with the attributes it drops
+type Cookie struct {
+	tls_client_cffi.Cookie
+	// seconds until the cookie expires, overriding expires. Negative deletes the cookie
+	MaxAge int `json:"maxAge,omitempty"`
+	// only sent over https
+	Secure   bool `json:"secure,omitempty"`
+	HttpOnly bool `json:"httpOnly,omitempty"`
+	// "Strict", "Lax" or "None"
+	SameSite string `json:"sameSite,omitempty"`
 }
 
-func buildCookies(cookies []tls_client_cffi.Cookie) []*http.Cookie {
+func buildCookies(cookies []Cookie) []*http.Cookie {
 	var ret []*http.Cookie
 
 	for _, cookie := range cookies {
 		ret = append(ret, &http.Cookie{
-			Name:    cookie.Name,
-			Value:   cookie.Value,
-			Path:    cookie.Path,
-			Domain:  cookie.Domain,
-			Expires: cookie.Expires.Time,
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			Expires:  cookie.Expires.Time,
+			MaxAge:   cookie.MaxAge,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			SameSite: parseSameSite(cookie.SameSite),
 		})
 	}
 
 	return ret
 }
 
-func transformCookies(cookies []*http.Cookie) []tls_client_cffi.Cookie {
-	var ret []tls_client_cffi.Cookie
+func transformCookies(cookies []*http.Cookie) []Cookie {
+	var ret []Cookie
 
 	for _, cookie := range cookies {
-		ret = append(ret, tls_client_cffi.Cookie{
-			Name:   cookie.Name,
-			Value:  cookie.Value,
-			Path:   cookie.Path,
-			Domain: cookie.Domain,
-			Expires: tls_client_cffi.Timestamp{
-				Time: cookie.Expires,
+		ret = append(ret, Cookie{
+			Cookie: tls_client_cffi.Cookie{
+				Name:   cookie.Name,
+				Value:  cookie.Value,
+				Path:   cookie.Path,
+				Domain: cookie.Domain,
+				Expires: tls_client_cffi.Timestamp{
+					Time: cookie.Expires,
+				},
 			},
+			MaxAge:   cookie.MaxAge,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			SameSite: sameSiteName(cookie.SameSite),
 		})
 	}
 
 	return ret
 }
+
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+func sameSiteName(mode http.SameSite) string {
+	switch mode {
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteNoneMode:
+		return "None"
+	}
+	return ""
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+)
+
+/*
+Reclaiming of idle sessions, by TTL and by a least recently used cap on the number of sessions
+*/
+
+type SessionLimitsConfig struct {
+	// destroy sessions unused for this many seconds, 0 keeps them
+	TtlSeconds int `json:"ttlSeconds"`
+	// destroy the least recently used sessions beyond this count, 0 for no limit
+	MaxSessions int `json:"maxSessions"`
+}
+
+type SessionEviction struct {
+	// increasing sequence number, pass the last one seen as ?since= to only get newer evictions
+	Seq       int64  `json:"seq"`
+	SessionId string `json:"sessionId"`
+	Label     string `json:"label,omitempty"`
+	// "ttl" or "lru"
+	Reason    string    `json:"reason"`
+	LastUsed  time.Time `json:"lastUsed"`
+	EvictedAt time.Time `json:"evictedAt"`
+}
+
+type SessionInfo struct {
+	SessionId string    `json:"sessionId"`
+	Label     string    `json:"label,omitempty"`
+	LastUsed  time.Time `json:"lastUsed"`
+	InFlight  int       `json:"inFlight"`
+	// cookie jar size, missing for sessions without a client yet
+	CookieJar *CookieJarStats `json:"cookieJar,omitempty"`
+}
+
+type SessionsOutput struct {
+	Sessions []SessionInfo `json:"sessions"`
+	// cookie jar sizes summed over all sessions
+	CookieJars CookieJarStats    `json:"cookieJars"`
+	Evictions  []SessionEviction `json:"evictions"`
+}
+
+const (
+	maxEvictionLog      = 1000
+	sessionSweepMinimum = time.Second
+	sessionSweepMaximum = time.Minute
+)
+
+var (
+	evictionsLock sync.Mutex
+	evictions     []SessionEviction
+	evictionSeq   int64
+	// evicted sessions not used since, mapped to the reason they were evicted
+	pendingEvictions = make(map[string]string)
+
+	sweeperLock sync.Mutex
+	sweeperStop chan struct{}
+)
+
+// touch marks the session as used by a request until the returned release is called
+func (s *sessionState) touch() func() {
+	s.mu.Lock()
+	s.lastUsed = time.Now()
+	s.inFlight++
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		s.lastUsed = time.Now()
+		s.inFlight--
+		s.mu.Unlock()
+	}
+}
+
+func getSessionLimits() SessionLimitsConfig {
+	if limits := getServerConfig().SessionLimits; limits != nil {
+		return *limits
+	}
+	return SessionLimitsConfig{}
+}
+
+// setSessionLimits (re)starts the sweeper evicting sessions by TTL
+func setSessionLimits(config *SessionLimitsConfig) {
+	sweeperLock.Lock()
+	defer sweeperLock.Unlock()
+	if sweeperStop != nil {
+		close(sweeperStop)
+		sweeperStop = nil
+	}
+	if config == nil || config.TtlSeconds <= 0 {
+		return
+	}
+	// sweep often enough for sessions to live at most about a tenth longer than their TTL
+	interval := time.Duration(config.TtlSeconds) * time.Second / 10
+	interval = min(max(interval, sessionSweepMinimum), sessionSweepMaximum)
+	stop := make(chan struct{})
+	sweeperStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				enforceSessionLimits()
+			}
+		}
+	}()
+}
+
+// enforceSessionLimits evicts expired sessions, then the least recently used ones above the cap.
+// Sessions with requests in flight, or used since they were listed, are never evicted
+func enforceSessionLimits() {
+	limits := getSessionLimits()
+	if limits.TtlSeconds <= 0 && limits.MaxSessions <= 0 {
+		return
+	}
+	infos := listSessions()
+	ttl := time.Duration(limits.TtlSeconds) * time.Second
+	var remaining []SessionInfo
+	for _, info := range infos {
+		expired := ttl > 0 && info.InFlight == 0 && time.Since(info.LastUsed) > ttl
+		if !expired || !evictSession(info, "ttl") {
+			remaining = append(remaining, info)
+		}
+	}
+	if limits.MaxSessions <= 0 || len(remaining) <= limits.MaxSessions {
+		return
+	}
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].LastUsed.Before(remaining[j].LastUsed)
+	})
+	excess := len(remaining) - limits.MaxSessions
+	for _, info := range remaining {
+		if excess == 0 {
+			break
+		}
+		if info.InFlight == 0 && evictSession(info, "lru") {
+			excess--
+		}
+	}
+}
+
+func listSessions() []SessionInfo {
+	sessionsLock.Lock()
+	states := make(map[string]*sessionState, len(sessions))
+	for sessionId, session := range sessions {
+		states[sessionId] = session
+	}
+	sessionsLock.Unlock()
+
+	infos := make([]SessionInfo, 0, len(states))
+	for sessionId, session := range states {
+		session.mu.Lock()
+		infos = append(infos, SessionInfo{
+			SessionId: sessionId,
+			Label:     session.label,
+			LastUsed:  session.lastUsed,
+			InFlight:  session.inFlight,
+		})
+		session.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].SessionId < infos[j].SessionId
+	})
+	return infos
+}
+
+// evictSession destroys the session locally, unless it was used since info was taken. A copy in the
+// session store is kept for other instances
+func evictSession(info SessionInfo, reason string) bool {
+	sessionsLock.Lock()
+	session, ok := sessions[info.SessionId]
+	if !ok {
+		sessionsLock.Unlock()
+		return false
+	}
+	session.mu.Lock()
+	busy := session.inFlight > 0 || !session.lastUsed.Equal(info.LastUsed)
+	if !busy {
+		tls_client_cffi.RemoveSession(info.SessionId)
+		delete(sessions, info.SessionId)
+	}
+	session.mu.Unlock()
+	sessionsLock.Unlock()
+	if busy {
+		return false
+	}
+
+	evictionsLock.Lock()
+	defer evictionsLock.Unlock()
+	evictionSeq++
+	evictions = append(evictions, SessionEviction{
+		Seq:       evictionSeq,
+		SessionId: info.SessionId,
+		Label:     info.Label,
+		Reason:    reason,
+		LastUsed:  info.LastUsed,
+		EvictedAt: time.Now(),
+	})
+	if len(evictions) > maxEvictionLog {
+		evictions = evictions[len(evictions)-maxEvictionLog:]
+	}
+	if len(pendingEvictions) < maxEvictionLog {
+		pendingEvictions[info.SessionId] = reason
+	}
+	return true
+}
+
+// takeEviction returns why the session was evicted before this request, if it was
+func takeEviction(sessionId string) string {
+	evictionsLock.Lock()
+	defer evictionsLock.Unlock()
+	reason := pendingEvictions[sessionId]
+	delete(pendingEvictions, sessionId)
+	return reason
+}
+
+func evictionsSince(seq int64) []SessionEviction {
+	evictionsLock.Lock()
+	defer evictionsLock.Unlock()
+	ret := []SessionEviction{}
+	for _, eviction := range evictions {
+		if eviction.Seq > seq {
+			ret = append(ret, eviction)
+		}
+	}
+	return ret
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Lists the live sessions and the sessions evicted after ?since=
+	*/
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	output := SessionsOutput{Sessions: listSessions(), Evictions: evictionsSince(since)}
+	for i, info := range output.Sessions {
+		if stats, ok := sessionJarStats(info.SessionId); ok {
+			output.Sessions[i].CookieJar = &stats
+			output.CookieJars.Cookies += stats.Cookies
+			output.CookieJars.Bytes += stats.Bytes
+			output.CookieJars.Evicted += stats.Evicted
+		}
+	}
+	writeJson(w, output)
+}
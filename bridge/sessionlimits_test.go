@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestEvictionSkipsBusySession(t *testing.T) {
+	sessionId := testSessionId(t)
+	session := getSession(sessionId)
+	t.Cleanup(func() { removeSession(sessionId) })
+	var info SessionInfo
+	for _, listed := range listSessions() {
+		if listed.SessionId == sessionId {
+			info = listed
+		}
+	}
+
+	// a request starting after the sessions were listed keeps the session
+	release := session.touch()
+	if evictSession(info, "lru") {
+		t.Error("session evicted with a request in flight")
+	}
+	release()
+	if evictSession(info, "lru") {
+		t.Error("session evicted although used since it was listed")
+	}
+	if getSession(sessionId) != session {
+		t.Error("busy session was removed")
+	}
+}
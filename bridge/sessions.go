@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+	"github.com/google/uuid"
+)
+
+/*
+Bridge-side state kept alongside each tls-client session
+*/
+
+type sessionState struct {
+	mu              sync.Mutex
+	rateLimitConfig *RateLimitConfig
+	limiter         *hostLimiter
+	resolverConfig  *ResolverConfig
+	dialOptions     *DialOptions
+	label           string
+	// the session's proxy needs 407 handling through the dial shim
+	proxyAuth bool
+	// input the session's tls-client was last built from
+	clientInput *tls_client_cffi.RequestInput
+	har         *harRecorder
+	// revision of the session last loaded from or saved to the session store, and the snapshot it holds
+	storeRevision int64
+	storeSnapshot string
+	lastUsed      time.Time
+	// requests currently using the session, which keep it from being evicted
+	inFlight int
+}
+
+var (
+	sessionsLock sync.Mutex
+	sessions     = make(map[string]*sessionState)
+)
+
+// getSession returns the state for sessionId, creating it if needed
+func getSession(sessionId string) *sessionState {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	session, ok := sessions[sessionId]
+	if !ok {
+		session = &sessionState{lastUsed: time.Now()}
+		sessions[sessionId] = session
+		if max := getSessionLimits().MaxSessions; max > 0 && len(sessions) > max {
+			go enforceSessionLimits()
+		}
+	}
+	return session
+}
+
+func removeSession(sessionId string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	delete(sessions, sessionId)
+}
+
+func clearSessions() {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sessions = make(map[string]*sessionState)
+}
+
+func sessionIds() []string {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	ids := make([]string, 0, len(sessions))
+	for sessionId := range sessions {
+		ids = append(ids, sessionId)
+	}
+	return ids
+}
+
+// setRateLimit replaces the session rate limiter, keeping the existing buckets if the config is unchanged
+func (s *sessionState) setRateLimit(config *RateLimitConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sameRateLimit(s.rateLimitConfig, config) {
+		return
+	}
+	s.rateLimitConfig = config
+	s.limiter = newHostLimiter(config)
+}
+
+// getLimiter returns the session limiter, or nil if the session has no rate limit of its own
+func (s *sessionState) getLimiter() (*hostLimiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limiter, s.rateLimitConfig != nil
+}
+
+func (s *sessionState) setClientInput(input tls_client_cffi.RequestInput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientInput = &input
+}
+
+// initClientInput records the input the session was created from, keeping any earlier record
+func (s *sessionState) initClientInput(input tls_client_cffi.RequestInput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientInput == nil {
+		s.clientInput = &input
+	}
+}
+
+func (s *sessionState) getClientInput() (tls_client_cffi.RequestInput, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientInput == nil {
+		return tls_client_cffi.RequestInput{}, false
+	}
+	return *s.clientInput, true
+}
+
+func (s *sessionState) setProxyAuth() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxyAuth = true
+}
+
+func (s *sessionState) getProxyAuth() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proxyAuth
+}
+
+func (s *sessionState) setResolver(config *ResolverConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resolverConfig = config
+}
+
+func (s *sessionState) getResolver() *ResolverConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resolverConfig
+}
+
+func (s *sessionState) setDialOptions(options *DialOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialOptions = options
+}
+
+func (s *sessionState) getDialOptions() *DialOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialOptions
+}
+
+func (s *sessionState) getHar() *harRecorder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.har == nil {
+		s.har = &harRecorder{}
+	}
+	return s.har
+}
+
+type BulkSessionInput struct {
+	Count int `json:"count"`
+	// client options shared by every session
+	Template ExtendedRequestInput `json:"template"`
+	// client identifiers mapped to their relative weight, e.g. {"chrome_117": 3, "firefox_117": 1}. A weight of 0 leaves a profile out
+	Profiles map[string]int `json:"profiles"`
+	// proxies assigned to the sessions, either in order ("roundRobin", the default) or at random ("random")
+	Proxies         []string `json:"proxies"`
+	ProxyAssignment string   `json:"proxyAssignment"`
+	LabelPrefix     string   `json:"labelPrefix"`
+}
+
+type BulkSession struct {
+	SessionId           string `json:"sessionId"`
+	Label               string `json:"label,omitempty"`
+	TLSClientIdentifier string `json:"tlsClientIdentifier,omitempty"`
+	ProxyUrl            string `json:"proxyUrl,omitempty"`
+	Error               string `json:"error,omitempty"`
+}
+
+type BulkSessionOutput struct {
+	Sessions []BulkSession `json:"sessions"`
+}
+
+const maxBulkSessions = 10000
+
+func bulkSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Creates several sessions at once from a shared template
+	*/
+	rawData := extractBody(w, r)
+	input := BulkSessionInput{}
+	err := decodeJson(r, rawData, &input)
+	if err != nil {
+		http.Error(w, invalidJsonMessage("bulk sessions", err), http.StatusBadRequest)
+		return
+	}
+	if input.Count < 1 || input.Count > maxBulkSessions {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxBulkSessions), http.StatusBadRequest)
+		return
+	}
+	if input.ProxyAssignment != "" && input.ProxyAssignment != "roundRobin" && input.ProxyAssignment != "random" {
+		http.Error(w, "proxyAssignment must be roundRobin or random", http.StatusBadRequest)
+		return
+	}
+
+	picker, err := newProfilePicker(input.Profiles)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	output := BulkSessionOutput{Sessions: make([]BulkSession, input.Count)}
+	for i := range output.Sessions {
+		params := input.Template
+		sessionId := uuid.New().String()
+		params.SessionId = &sessionId
+		if profile := picker.next(); profile != "" {
+			params.TLSClientIdentifier = profile
+			params.CustomTlsClient = nil
+		}
+		if len(input.Proxies) > 0 {
+			proxyUrl := input.Proxies[i%len(input.Proxies)]
+			if input.ProxyAssignment == "random" {
+				proxyUrl = input.Proxies[mathrand.Intn(len(input.Proxies))]
+			}
+			params.ProxyUrl = &proxyUrl
+		}
+
+		result := BulkSession{SessionId: sessionId, TLSClientIdentifier: params.TLSClientIdentifier}
+		if input.LabelPrefix != "" {
+			result.Label = fmt.Sprintf("%s%d", input.LabelPrefix, i)
+		}
+		if params.ProxyUrl != nil {
+			result.ProxyUrl = *params.ProxyUrl
+		}
+		if err := createSession(&params, result.Label); err != nil {
+			result.Error = err.Error()
+		}
+		output.Sessions[i] = result
+	}
+	writeJson(w, output)
+}
+
+// createSession builds the tls-client for a session up front and applies its bridge-side options
+func createSession(params *ExtendedRequestInput, label string) error {
+	sessionId := *params.SessionId
+	session := getSession(sessionId)
+	session.mu.Lock()
+	session.label = label
+	session.mu.Unlock()
+	if params.RateLimit != nil {
+		session.setRateLimit(params.RateLimit)
+	}
+
+	clientInput, clientErr := buildClientInput(params)
+	if clientErr == nil {
+		_, _, _, clientErr = tls_client_cffi.CreateClient(clientInput)
+	}
+	if clientErr != nil {
+		removeSession(sessionId)
+		return clientErr
+	}
+	session.setClientInput(clientInput)
+	return nil
+}
+
+// rebuildSessionClient recreates the tls-client of a session from a modified input,
+// carrying over its cookie jar, proxy and redirect setting. The session keeps its old client when the new one can't be built
+func rebuildSessionClient(sessionId string, modify func(input *tls_client_cffi.RequestInput)) error {
+	oldClient, err := tls_client_cffi.GetClient(sessionId)
+	if err != nil {
+		return err
+	}
+	session := getSession(sessionId)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.clientInput == nil {
+		return fmt.Errorf("session %s was not created by the bridge", sessionId)
+	}
+
+	oldInput := *session.clientInput
+	oldInput.SessionId = &sessionId
+	if proxyUrl := oldClient.GetProxy(); proxyUrl != "" {
+		oldInput.ProxyUrl = &proxyUrl
+	}
+	oldInput.FollowRedirects = oldClient.GetFollowRedirect()
+	input := oldInput
+	modify(&input)
+
+	// built without a session first, so an invalid input leaves the session untouched
+	unregistered := input
+	unregistered.SessionId = nil
+	if _, _, _, clientErr := tls_client_cffi.CreateClient(unregistered); clientErr != nil {
+		return clientErr
+	}
+
+	tls_client_cffi.RemoveSession(sessionId)
+	newClient, _, _, clientErr := tls_client_cffi.CreateClient(input)
+	if clientErr != nil {
+		// put back a client built like the old one
+		if restored, _, _, err := tls_client_cffi.CreateClient(oldInput); err == nil {
+			restored.SetCookieJar(oldClient.GetCookieJar())
+		}
+		return clientErr
+	}
+	newClient.SetCookieJar(oldClient.GetCookieJar())
+	oldClient.CloseIdleConnections()
+	session.clientInput = &input
+	return nil
+}
+
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Routes /session/{id}/{action}
+	*/
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/session/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sessionId, action := parts[0], parts[1]
+	switch action {
+	case "transport":
+		sessionTransportHandler(w, r, sessionId)
+	case "save":
+		sessionSaveHandler(w, r, sessionId)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type SessionTransportOutput struct {
+	SessionId        string                            `json:"sessionId"`
+	TransportOptions *tls_client_cffi.TransportOptions `json:"transportOptions"`
+}
+
+func sessionTransportHandler(w http.ResponseWriter, r *http.Request, sessionId string) {
+	/*
+		GET returns the session's transport options, POST replaces them
+	*/
+	if r.Method == http.MethodPost {
+		rawData := extractBody(w, r)
+		options := tls_client_cffi.TransportOptions{}
+		err := decodeJson(r, rawData, &options)
+		if err != nil {
+			http.Error(w, invalidJsonMessage("transport options", err), http.StatusBadRequest)
+			return
+		}
+		err = rebuildSessionClient(sessionId, func(input *tls_client_cffi.RequestInput) {
+			input.TransportOptions = &options
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	input, ok := getSession(sessionId).getClientInput()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no client found for sessionId: %s", sessionId), http.StatusNotFound)
+		return
+	}
+	writeJson(w, SessionTransportOutput{SessionId: sessionId, TransportOptions: input.TransportOptions})
+}
+
+// profilePicker distributes client identifiers by weight using smooth weighted round robin
+type profilePicker struct {
+	names   []string
+	weights []int
+	current []int
+	total   int
+}
+
+// newProfilePicker skips profiles weighted below 1, failing when that leaves none of the given profiles
+func newProfilePicker(profiles map[string]int) (*profilePicker, error) {
+	picker := &profilePicker{}
+	for name, weight := range profiles {
+		if weight >= 1 {
+			picker.names = append(picker.names, name)
+		}
+	}
+	if len(profiles) > 0 && len(picker.names) == 0 {
+		return nil, fmt.Errorf("every profile has a weight below 1")
+	}
+	// map iteration order is random, sort to keep the distribution deterministic
+	sort.Strings(picker.names)
+	for _, name := range picker.names {
+		weight := profiles[name]
+		picker.weights = append(picker.weights, weight)
+		picker.total += weight
+	}
+	picker.current = make([]int, len(picker.names))
+	return picker, nil
+}
+
+func (p *profilePicker) next() string {
+	if len(p.names) == 0 {
+		return ""
+	}
+	best := 0
+	for i := range p.current {
+		p.current[i] += p.weights[i]
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.names[best]
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	tls_client_cffi "github.com/bogdanfinn/tls-client/cffi_src"
+)
+
+func TestRebuildSessionClientKeepsSessionOnError(t *testing.T) {
+	server := newOrigin(t, originHttp1)
+	sessionId := testSessionId(t)
+	finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/set-cookie/kept/1"}))
+
+	// a client identifier together with a custom client can't be built
+	err := rebuildSessionClient(sessionId, func(input *tls_client_cffi.RequestInput) {
+		input.TLSClientIdentifier = "chrome_117"
+		input.CustomTlsClient = &tls_client_cffi.CustomTlsClient{}
+	})
+	if err == nil {
+		t.Fatal("rebuild with an invalid input succeeded")
+	}
+	response := finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/echo"}))
+	if cookies := echoed(t, response)["cookies"].(map[string]any); cookies["kept"] != "1" {
+		t.Errorf("session lost its cookies after a failed rebuild, got %v", cookies)
+	}
+}
+
+func TestProfilePickerWeights(t *testing.T) {
+	picker, err := newProfilePicker(map[string]int{"chrome_117": 2, "firefox_117": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if profile := picker.next(); profile != "chrome_117" {
+			t.Errorf("picked %s, a profile weighted 0", profile)
+		}
+	}
+	if _, err := newProfilePicker(map[string]int{"chrome_117": 0, "firefox_117": -1}); err == nil {
+		t.Error("picker built without any usable profile")
+	}
+}
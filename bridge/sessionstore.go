@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	json "github.com/goccy/go-json"
+)
+
+/*
+Shared session state in Redis, so any bridge instance in a cluster can serve any session.
+Sessions are loaded before a request when another instance saved a newer revision,
+and saved after it when it changed. Concurrent requests on one session from several instances are last write wins
+*/
+
+const defaultSessionStorePrefix = "hrequests:session:"
+
+type SessionStoreConfig struct {
+	// redis://[:password@]host:6379/db, rediss:// for TLS
+	Url string `json:"url"`
+	// key prefix, defaults to "hrequests:session:"
+	Prefix string `json:"prefix"`
+	// expire stored sessions after this many seconds without use, 0 keeps them
+	TtlSeconds int `json:"ttlSeconds"`
+}
+
+var (
+	sessionStoreLock   sync.Mutex
+	sessionStoreUrl    string
+	sessionStoreClient *redisClient
+)
+
+// getSessionStore returns the store client and config, or nil if no store is configured
+func getSessionStore() (*redisClient, *SessionStoreConfig) {
+	config := getServerConfig().SessionStore
+	if config == nil || config.Url == "" {
+		return nil, nil
+	}
+	sessionStoreLock.Lock()
+	defer sessionStoreLock.Unlock()
+	if sessionStoreClient == nil || sessionStoreUrl != config.Url {
+		if sessionStoreClient != nil {
+			sessionStoreClient.close()
+		}
+		client, err := newRedisClient(config.Url)
+		if err != nil {
+			return nil, nil
+		}
+		sessionStoreClient, sessionStoreUrl = client, config.Url
+	}
+	return sessionStoreClient, config
+}
+
+func sessionStoreKey(config *SessionStoreConfig, sessionId string) string {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultSessionStorePrefix
+	}
+	return prefix + sessionId
+}
+
+// loadStoredSession restores a session from the store when it holds a newer revision than this instance
+func loadStoredSession(sessionId string) error {
+	client, config := getSessionStore()
+	if client == nil {
+		return nil
+	}
+	encoded, isNil, err := client.do("GET", sessionStoreKey(config, sessionId))
+	if err != nil || isNil {
+		return err
+	}
+	snapshot := &SessionSnapshot{}
+	if err := json.Unmarshal([]byte(encoded), snapshot); err != nil {
+		return err
+	}
+
+	session := getSession(sessionId)
+	session.mu.Lock()
+	current := session.storeRevision
+	session.mu.Unlock()
+	if snapshot.Revision <= current {
+		return nil
+	}
+
+	snapshot.SessionId = sessionId
+	if _, err := restoreSession(snapshot); err != nil {
+		return err
+	}
+	// remember what was loaded, so saving it back unchanged is skipped
+	loaded := ""
+	if restored, err := snapshotSession(sessionId); err == nil {
+		loaded = marshalSnapshot(restored)
+	}
+	session.mu.Lock()
+	session.storeRevision = snapshot.Revision
+	session.storeSnapshot = loaded
+	session.mu.Unlock()
+	return nil
+}
+
+// marshalSnapshot encodes a snapshot without its revision, to tell whether a session changed
+func marshalSnapshot(snapshot *SessionSnapshot) string {
+	unrevised := *snapshot
+	unrevised.Revision = 0
+	encoded, _ := json.Marshal(unrevised)
+	return string(encoded)
+}
+
+// saveStoredSession writes the session to the store under the next revision.
+// A session that didn't change since it was last loaded or saved only has its expiry refreshed
+func saveStoredSession(sessionId string) error {
+	client, config := getSessionStore()
+	if client == nil {
+		return nil
+	}
+	snapshot, err := snapshotSession(sessionId)
+	if err != nil {
+		return err
+	}
+	key := sessionStoreKey(config, sessionId)
+	unrevised := marshalSnapshot(snapshot)
+	session := getSession(sessionId)
+	session.mu.Lock()
+	unchanged := unrevised == session.storeSnapshot
+	session.mu.Unlock()
+	if unchanged {
+		if config.TtlSeconds <= 0 {
+			return nil
+		}
+		// EXPIRE answers 0 when the key is gone, write it again then
+		if refreshed, _, err := client.do("EXPIRE", key, strconv.Itoa(config.TtlSeconds)); err != nil || refreshed != "0" {
+			return err
+		}
+	}
+
+	session.mu.Lock()
+	session.storeRevision++
+	snapshot.Revision = session.storeRevision
+	session.mu.Unlock()
+
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	args := []string{"SET", key, string(encoded)}
+	if config.TtlSeconds > 0 {
+		args = append(args, "EX", strconv.Itoa(config.TtlSeconds))
+	}
+	if _, _, err = client.do(args...); err != nil {
+		return err
+	}
+	session.mu.Lock()
+	session.storeSnapshot = unrevised
+	session.mu.Unlock()
+	return nil
+}
+
+func deleteStoredSession(sessionId string) {
+	if client, config := getSessionStore(); client != nil {
+		client.do("DEL", sessionStoreKey(config, sessionId))
+	}
+}
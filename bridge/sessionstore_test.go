@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+// fakeRedis serves GET, SET, EXPIRE and DEL from memory and counts the SETs it received
+type fakeRedis struct {
+	mu   sync.Mutex
+	keys map[string]string
+	sets int
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	store := &fakeRedis{keys: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go store.serve(conn)
+		}
+	}()
+	return store, "redis://" + listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			header, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+		conn.Write([]byte(f.reply(args)))
+	}
+}
+
+func (f *fakeRedis) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := f.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		f.keys[args[1]] = args[2]
+		f.sets++
+		return "+OK\r\n"
+	case "EXPIRE":
+		if _, ok := f.keys[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "DEL":
+		delete(f.keys, args[1])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) setCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sets
+}
+
+func TestSessionStoreKeepsSessionState(t *testing.T) {
+	store, storeUrl := newFakeRedis(t)
+	old := getServerConfig()
+	config := old.clone()
+	config.SessionStore = &SessionStoreConfig{Url: storeUrl}
+	setServerConfig(config)
+	t.Cleanup(func() { setServerConfig(old) })
+
+	server := newOrigin(t, originHttp1)
+	sessionId := testSessionId(t)
+	key := defaultSessionStorePrefix + sessionId
+
+	finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/set-cookie/a/1"}))
+	if store.setCount() != 1 {
+		t.Fatalf("%d SETs after a request setting a cookie, want 1", store.setCount())
+	}
+
+	// nothing changed, nothing is written
+	finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/echo"}))
+	if store.setCount() != 1 {
+		t.Errorf("%d SETs after a request changing nothing, want 1", store.setCount())
+	}
+
+	// another instance saves a newer revision with another cookie
+	store.mu.Lock()
+	snapshot := &SessionSnapshot{}
+	json.Unmarshal([]byte(store.keys[key]), snapshot)
+	snapshot.Revision++
+	for host, cookies := range snapshot.Cookies {
+		added := *cookies[0]
+		added.Name = "b"
+		snapshot.Cookies[host] = append(cookies, &added)
+	}
+	encoded, _ := json.Marshal(snapshot)
+	store.keys[key] = string(encoded)
+	store.mu.Unlock()
+
+	session := getSession(sessionId)
+	release := session.touch()
+	response := finalResponse(t, bridgeRequest(t, map[string]any{"sessionId": sessionId, "requestUrl": server.URL + "/echo"}))
+	if cookies := echoed(t, response)["cookies"].(map[string]any); cookies["a"] != "1" || cookies["b"] != "1" {
+		t.Errorf("cookies %v after loading a newer revision, want a=1 and b=1", cookies)
+	}
+	if getSession(sessionId) != session {
+		t.Error("loading the session replaced its state")
+	}
+	session.mu.Lock()
+	inFlight := session.inFlight
+	session.mu.Unlock()
+	release()
+	if inFlight != 1 {
+		t.Errorf("%d requests in flight after loading, want the 1 held by the test", inFlight)
+	}
+	if store.setCount() != 1 {
+		t.Errorf("%d SETs after loading a session unchanged, want 1", store.setCount())
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Sinks publish every completed response to a message queue, independently of the caller
+*/
+
+const (
+	sinkQueueSize   = 1000
+	sinkDialTimeout = 10 * time.Second
+)
+
+type SinkConfig struct {
+	// "redis", "nats" or "kafkaRest". Kafka is reached through a Kafka REST Proxy, not the Kafka protocol
+	Type string `json:"type"`
+	// redis://[:password@]host:6379/db (rediss:// for TLS), nats://[user:pass@]host:4222,
+	// or the base url of the Kafka REST Proxy, e.g. http://host:8082
+	Url string `json:"url"`
+	// Redis channel or key, NATS subject or Kafka topic
+	Topic string `json:"topic"`
+	// redis only: "publish" (default), "rpush" or "xadd"
+	Mode string `json:"mode"`
+}
+
+type SinkStats struct {
+	Type      string `json:"type"`
+	Topic     string `json:"topic"`
+	Published int64  `json:"published"`
+	// responses dropped because the queue was full
+	Dropped int64 `json:"dropped"`
+	Failed  int64 `json:"failed"`
+	// last publishing error
+	LastError string `json:"lastError,omitempty"`
+}
+
+// sinkPublisher delivers a single message, reconnecting as needed
+type sinkPublisher interface {
+	publish(message []byte) error
+	close()
+}
+
+type sinkWorker struct {
+	config    SinkConfig
+	publisher sinkPublisher
+	// never closed, publishToSinks may still send to it after the worker was replaced
+	queue chan []byte
+	// closed by setSinks to stop the worker
+	done      chan struct{}
+	published atomic.Int64
+	dropped   atomic.Int64
+	failed    atomic.Int64
+	lastError atomic.Pointer[string]
+}
+
+var (
+	sinksLock   sync.Mutex
+	sinkConfigs []SinkConfig
+	sinkWorkers []*sinkWorker
+)
+
+// setSinks replaces the running sinks when their config changed
+func setSinks(configs []SinkConfig) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+	if reflect.DeepEqual(configs, sinkConfigs) {
+		return
+	}
+	for _, worker := range sinkWorkers {
+		close(worker.done)
+	}
+	sinkConfigs = configs
+	sinkWorkers = nil
+	for _, config := range configs {
+		worker := &sinkWorker{config: config, queue: make(chan []byte, sinkQueueSize), done: make(chan struct{})}
+		publisher, err := newSinkPublisher(config)
+		if err != nil {
+			message := err.Error()
+			worker.lastError.Store(&message)
+		} else {
+			worker.publisher = publisher
+			go worker.run()
+		}
+		sinkWorkers = append(sinkWorkers, worker)
+	}
+}
+
+func validateSinks(configs []SinkConfig) error {
+	for _, config := range configs {
+		if _, err := newSinkPublisher(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSinkPublisher(config SinkConfig) (sinkPublisher, error) {
+	if config.Topic == "" {
+		return nil, fmt.Errorf("%s sink requires a topic", config.Type)
+	}
+	target, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s sink url: %w", config.Type, err)
+	}
+	switch config.Type {
+	case "redis":
+		if config.Mode != "" && config.Mode != "publish" && config.Mode != "rpush" && config.Mode != "xadd" {
+			return nil, fmt.Errorf("redis sink mode must be publish, rpush or xadd")
+		}
+		client, err := newRedisClient(config.Url)
+		if err != nil {
+			return nil, err
+		}
+		return &redisPublisher{client: client, config: config}, nil
+	case "nats":
+		return &natsPublisher{target: target, config: config}, nil
+	case "kafka":
+		return nil, fmt.Errorf("kafka sinks publish through a Kafka REST Proxy, use type kafkaRest with the proxy url")
+	case "kafkaRest":
+		return &kafkaRestPublisher{endpoint: strings.TrimSuffix(config.Url, "/") + "/topics/" + url.PathEscape(config.Topic)}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+}
+
+func (s *sinkWorker) run() {
+	defer s.publisher.close()
+	for {
+		select {
+		case message := <-s.queue:
+			s.publish(message)
+		case <-s.done:
+			// deliver what was queued before the sinks were replaced
+			for {
+				select {
+				case message := <-s.queue:
+					s.publish(message)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *sinkWorker) publish(message []byte) {
+	if err := s.publisher.publish(message); err != nil {
+		s.failed.Add(1)
+		errorMessage := err.Error()
+		s.lastError.Store(&errorMessage)
+		return
+	}
+	s.published.Add(1)
+}
+
+// publishToSinks queues the response sent back for a request on every configured sink
+func publishToSinks(response any) {
+	sinksLock.Lock()
+	workers := sinkWorkers
+	sinksLock.Unlock()
+	if len(workers) == 0 {
+		return
+	}
+
+	message, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	for _, worker := range workers {
+		if worker.publisher == nil {
+			continue
+		}
+		select {
+		case worker.queue <- message:
+		default:
+			worker.dropped.Add(1)
+		}
+	}
+}
+
+func sinksHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Returns delivery statistics of the configured sinks
+	*/
+	sinksLock.Lock()
+	stats := make([]SinkStats, len(sinkWorkers))
+	for i, worker := range sinkWorkers {
+		stats[i] = SinkStats{
+			Type:      worker.config.Type,
+			Topic:     worker.config.Topic,
+			Published: worker.published.Load(),
+			Dropped:   worker.dropped.Load(),
+			Failed:    worker.failed.Load(),
+		}
+		if lastError := worker.lastError.Load(); lastError != nil {
+			stats[i].LastError = *lastError
+		}
+	}
+	sinksLock.Unlock()
+	writeJson(w, stats)
+}
+
+func dialSink(target *url.URL, defaultPort string, useTls bool) (net.Conn, error) {
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), defaultPort)
+	}
+	dialer := &net.Dialer{Timeout: sinkDialTimeout}
+	if useTls {
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: target.Hostname()})
+	}
+	return dialer.Dial("tcp", host)
+}
+
+// redisPublisher publishes to a channel, list or stream
+type redisPublisher struct {
+	client *redisClient
+	config SinkConfig
+}
+
+func (p *redisPublisher) publish(message []byte) error {
+	var err error
+	switch p.config.Mode {
+	case "rpush":
+		_, _, err = p.client.do("RPUSH", p.config.Topic, string(message))
+	case "xadd":
+		_, _, err = p.client.do("XADD", p.config.Topic, "*", "response", string(message))
+	default:
+		_, _, err = p.client.do("PUBLISH", p.config.Topic, string(message))
+	}
+	return err
+}
+
+func (p *redisPublisher) close() {
+	p.client.close()
+}
+
+// natsPublisher speaks the NATS text protocol, answering server pings in the background
+type natsPublisher struct {
+	target *url.URL
+	config SinkConfig
+	mu     sync.Mutex
+	conn   net.Conn
+	err    error
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := dialSink(p.target, "4222", p.target.Scheme == "tls")
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sinkDialTimeout))
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q: %v", line, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "hrequests-bridge"}
+	if username := p.target.User.Username(); username != "" {
+		if password, ok := p.target.User.Password(); ok {
+			options["user"], options["pass"] = username, password
+		} else {
+			options["auth_token"] = username
+		}
+	}
+	encoded, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", encoded); err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn, p.err = conn, nil
+	go p.readLoop(conn, reader)
+	return nil
+}
+
+func (p *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		p.mu.Lock()
+		if p.conn != conn {
+			p.mu.Unlock()
+			return
+		}
+		if err != nil {
+			p.err = err
+			p.mu.Unlock()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "-ERR"):
+			p.err = fmt.Errorf("nats: %s", strings.TrimSpace(line[4:]))
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *natsPublisher) publish(message []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil && p.err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(sinkDialTimeout))
+	_, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", p.config.Topic, len(message), message)
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *natsPublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// kafkaRestPublisher produces records through a Kafka REST Proxy
+type kafkaRestPublisher struct {
+	endpoint string
+}
+
+var kafkaClient = &http.Client{Timeout: 30 * time.Second}
+
+func (p *kafkaRestPublisher) publish(message []byte) error {
+	var body bytes.Buffer
+	body.WriteString(`{"records":[{"value":`)
+	body.Write(message)
+	body.WriteString(`}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, p.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	resp, err := kafkaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kafkaRest: REST proxy returned status %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+func (p *kafkaRestPublisher) close() {}
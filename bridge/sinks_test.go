@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	stdhttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKafkaRestSink(t *testing.T) {
+	if err := validateSinks([]SinkConfig{{Type: "kafka", Url: "http://localhost:8082", Topic: "responses"}}); err == nil || !strings.Contains(err.Error(), "kafkaRest") {
+		t.Errorf("kafka sink accepted or not pointed at kafkaRest: %v", err)
+	}
+
+	var path, contentType, body string
+	proxy := httptest.NewServer(stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		path, contentType, body = r.URL.Path, r.Header.Get("Content-Type"), string(raw)
+	}))
+	defer proxy.Close()
+
+	publisher, err := newSinkPublisher(SinkConfig{Type: "kafkaRest", Url: proxy.URL + "/", Topic: "responses"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.publish([]byte(`{"status":200}`)); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/topics/responses" || contentType != "application/vnd.kafka.json.v2+json" || body != `{"records":[{"value":{"status":200}}]}` {
+		t.Errorf("posted %q to %s as %s", body, path, contentType)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+NDJSON streaming of /multirequest results
+*/
+
+// StreamedResult is one line of a streamed multirequest, in completion order
+type StreamedResult struct {
+	// position of the request in the submitted batch
+	Index  int `json:"index"`
+	Result any `json:"result"`
+}
+
+// StreamedSummary is the last line of a streamed multirequest when a summary was asked for
+type StreamedSummary struct {
+	Summary *BatchSummary `json:"summary"`
+}
+
+func streamMultiRequest(w http.ResponseWriter, r *http.Request, requests []ExtendedRequestInput, wantSummary bool, slowest int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	// fhttp buffers the body, flush after every line so the client sees results as they complete
+	flusher, _ := w.(http.Flusher)
+	writeLine := func(v any) {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		w.Write(append(line, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	wrappers := make([]*ResponseWrapper, len(requests))
+	durations := make([]time.Duration, len(requests))
+	start := time.Now()
+
+	for indexedWrapper := range runBatch(r.Context(), requests, durations) {
+		i := indexedWrapper.int
+		wrappers[i] = indexedWrapper.ResponseWrapper
+		// write errors are ignored, the batch is drained either way so every goroutine can finish
+		writeLine(StreamedResult{Index: i, Result: wrapResponse(&requests[i], indexedWrapper.ResponseWrapper)})
+	}
+	if wantSummary {
+		writeLine(StreamedSummary{Summary: summarizeBatch(requests, wrappers, durations, time.Since(start), slowest)})
+	}
+}
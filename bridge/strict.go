@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	json "github.com/goccy/go-json"
+)
+
+/*
+Strict decoding of request payloads, rejecting fields the bridge doesn't know
+*/
+
+const strictJsonHeader = "X-Bridge-Strict"
+
+// UnknownFieldError is returned in strict mode for a payload field matching no option
+type UnknownFieldError struct {
+	Field string
+	// closest known field name, if any is similar enough
+	Suggestion string
+}
+
+func (e *UnknownFieldError) Error() string {
+	if e.Suggestion != "" {
+		return fmt.Sprintf("unknown field %q, did you mean %q?", e.Field, e.Suggestion)
+	}
+	return fmt.Sprintf("unknown field %q", e.Field)
+}
+
+// isStrict reports whether unknown fields should be rejected: per call through ?strict= or the
+// X-Bridge-Strict header, or server-wide through the strictJson config option
+func isStrict(r *http.Request) bool {
+	for _, value := range []string{r.URL.Query().Get("strict"), r.Header.Get(strictJsonHeader)} {
+		if strict, err := strconv.ParseBool(value); err == nil {
+			return strict
+		}
+	}
+	return getServerConfig().StrictJson
+}
+
+// decodeJson unmarshals a request payload into v, rejecting unknown fields in strict mode
+func decodeJson(r *http.Request, data []byte, v any) error {
+	if !isStrict(r) {
+		return json.Unmarshal(data, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if name, unquoteErr := strconv.Unquote(field); unquoteErr == nil {
+			return &UnknownFieldError{Field: name, Suggestion: suggestField(name, reflect.TypeOf(v))}
+		}
+	}
+	return err
+}
+
+// invalidJsonMessage is the error returned for a payload that failed to decode, detailing unknown fields
+func invalidJsonMessage(name string, err error) string {
+	if unknown, ok := err.(*UnknownFieldError); ok {
+		return fmt.Sprintf("Invalid JSON format for %s: %s", name, unknown)
+	}
+	return "Invalid JSON format for " + name
+}
+
+// suggestField finds the known field name closest to name anywhere in t
+func suggestField(name string, t reflect.Type) string {
+	names := make(map[string]bool)
+	collectFieldNames(t, names, make(map[reflect.Type]bool))
+	best, bestDistance := "", len(name)/3+1
+	lower := strings.ToLower(name)
+	for candidate := range names {
+		distance := editDistance(lower, strings.ToLower(candidate))
+		if distance < bestDistance || (distance == bestDistance && best != "" && candidate < best) {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+func collectFieldNames(t reflect.Type, names map[string]bool, seen map[reflect.Type]bool) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" {
+			collectFieldNames(field.Type, names, seen)
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		names[tag] = true
+		collectFieldNames(field.Type, names, seen)
+	}
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	http "github.com/bogdanfinn/fhttp"
+)
+
+func TestStrictFieldSuggestions(t *testing.T) {
+	tests := []struct {
+		payload    string
+		field      string
+		suggestion string
+	}{
+		{`{"requestUrll": "http://example.com"}`, "requestUrll", "requestUrl"},
+		{`{"RequestURL": "http://example.com"}`, "RequestURL", "requestUrl"},
+		{`{"parallelRanges": {"segmnts": 4}}`, "segmnts", "segments"},
+		{`{"xyzzy": true}`, "xyzzy", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "/request?strict=true", nil)
+		err := decodeJson(req, []byte(test.payload), &ExtendedRequestInput{})
+		var unknown *UnknownFieldError
+		if !errors.As(err, &unknown) {
+			t.Errorf("%s: error %v, want an unknown field", test.payload, err)
+			continue
+		}
+		if unknown.Field != test.field || unknown.Suggestion != test.suggestion {
+			t.Errorf("%s: field %q suggesting %q, want %q suggesting %q", test.payload, unknown.Field, unknown.Suggestion, test.field, test.suggestion)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/request", nil)
+	if err := decodeJson(req, []byte(`{"requestUrll": "http://example.com"}`), &ExtendedRequestInput{}); err != nil {
+		t.Errorf("unknown field rejected outside strict mode: %v", err)
+	}
+	req.Header.Set(strictJsonHeader, "true")
+	err := decodeJson(req, []byte(`{"requestUrll": "http://example.com"}`), &ExtendedRequestInput{})
+	if message := invalidJsonMessage("request", err); message != `Invalid JSON format for request: unknown field "requestUrll", did you mean "requestUrl"?` {
+		t.Errorf("message %q", message)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Aggregate statistics over the results of a /multirequest batch
+*/
+
+const defaultSlowestEntries = 5
+
+type BatchSummary struct {
+	Count     int     `json:"count"`
+	Succeeded int     `json:"succeeded"`
+	Failed    int     `json:"failed"`
+	TotalMs   float64 `json:"totalMs"`
+	// number of responses per status code, failed requests are counted under "error"
+	Statuses map[string]int `json:"statuses"`
+	// number of failures per error code, see ResponseError
+	Errors map[string]int `json:"errors"`
+	// size of the response bodies received, after decompression
+	BytesTransferred int64         `json:"bytesTransferred"`
+	Slowest          []BatchTiming `json:"slowest"`
+}
+
+type BatchTiming struct {
+	Index      int     `json:"index"`
+	Url        string  `json:"url"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+type MultiRequestOutput struct {
+	Results []any         `json:"results"`
+	Summary *BatchSummary `json:"summary"`
+}
+
+// summarizeBatch aggregates the final responses of a batch, keeping the slowest n entries
+func summarizeBatch(requests []ExtendedRequestInput, wrappers []*ResponseWrapper, durations []time.Duration, total time.Duration, slowest int) *BatchSummary {
+	summary := &BatchSummary{
+		Count:    len(wrappers),
+		TotalMs:  milliseconds(total),
+		Statuses: make(map[string]int),
+		Errors:   make(map[string]int),
+		Slowest:  []BatchTiming{},
+	}
+	timings := make([]BatchTiming, 0, len(wrappers))
+	for i, wrapper := range wrappers {
+		response := wrapper.Response
+		if wrapper.IsHistory && len(wrapper.History) > 0 {
+			response = wrapper.History[len(wrapper.History)-1]
+		}
+		timing := BatchTiming{Index: i, Url: requests[i].RequestUrl, DurationMs: milliseconds(durations[i])}
+
+		if response == nil || response.Status == 0 {
+			summary.Failed++
+			summary.Statuses["error"]++
+			code := "unknown"
+			if response != nil && response.Error != nil {
+				code = response.Error.Code
+			}
+			summary.Errors[code]++
+		} else {
+			summary.Succeeded++
+			summary.Statuses[strconv.Itoa(response.Status)]++
+			summary.BytesTransferred += bodySize(response.Body)
+			timing.Status = response.Status
+		}
+		timings = append(timings, timing)
+	}
+
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].DurationMs > timings[j].DurationMs })
+	if len(timings) > slowest {
+		timings = timings[:slowest]
+	}
+	summary.Slowest = append(summary.Slowest, timings...)
+	return summary
+}
+
+// bodySize returns the size of a response body, decoding the length of base64 data urls
+func bodySize(body string) int64 {
+	if strings.HasPrefix(body, "data:") {
+		if _, encoded, ok := strings.Cut(body, ";base64,"); ok {
+			return int64(len(encoded) / 4 * 3)
+		}
+	}
+	return int64(len(body))
+}
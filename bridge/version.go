@@ -0,0 +1,126 @@
+package main
+
+import (
+	_ "embed"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	"github.com/bogdanfinn/tls-client/profiles"
+)
+
+/*
+Build information, so the Python client can adapt to a bridge library of another version
+instead of failing on the first request it doesn't understand
+*/
+
+//go:embed VERSION
+var versionFile string
+
+// bridgeVersion is the version the library is released under, hrequests-cgo-{version}
+var bridgeVersion = strings.TrimSpace(versionFile)
+
+type VersionOutput struct {
+	Version string `json:"version"`
+	// version of the tls-client module the bridge was built with
+	TlsClient string `json:"tlsClient"`
+	// the other modules the request path depends on, mapped to their version
+	Dependencies map[string]string `json:"dependencies"`
+	GoVersion    string            `json:"goVersion"`
+	// GOOS/GOARCH of the library
+	Platform string `json:"platform"`
+	// names accepted as tlsClientIdentifier, sorted
+	Profiles []string `json:"profiles"`
+	// application protocols requests can be sent over
+	Protocols map[string]bool `json:"protocols"`
+	// optional subsystems and whether this build has them, same as /capabilities
+	Capabilities map[string]bool `json:"capabilities"`
+	// every field /request accepts, sorted
+	RequestOptions []string `json:"requestOptions"`
+}
+
+// modules reported by /version, the first one as tlsClient
+var versionedModules = []string{
+	"github.com/bogdanfinn/tls-client",
+	"github.com/bogdanfinn/fhttp",
+	"github.com/bogdanfinn/utls",
+}
+
+func buildVersion() VersionOutput {
+	output := VersionOutput{
+		Version:      bridgeVersion,
+		Dependencies: make(map[string]string),
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		Profiles:     make([]string, 0, len(profiles.MappedTLSClients)),
+		// tls-client has no HTTP/3 transport
+		Protocols:      map[string]bool{"http/1.1": true, "h2": true, "h3": false},
+		Capabilities:   listCapabilities().Capabilities,
+		RequestOptions: jsonFieldNames(reflect.TypeOf(ExtendedRequestInput{})),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, module := range info.Deps {
+			if module.Replace != nil {
+				module = module.Replace
+			}
+			for _, path := range versionedModules {
+				if module.Path == path {
+					output.Dependencies[path] = module.Version
+				}
+			}
+		}
+	}
+	output.TlsClient = output.Dependencies[versionedModules[0]]
+	delete(output.Dependencies, versionedModules[0])
+
+	for name := range profiles.MappedTLSClients {
+		output.Profiles = append(output.Profiles, name)
+	}
+	sort.Strings(output.Profiles)
+	return output
+}
+
+// jsonFieldNames lists the JSON names of the exported fields of t, including those of embedded structs.
+// Names redeclared over an embedded struct are listed once
+func jsonFieldNames(t reflect.Type) []string {
+	seen := make(map[string]bool)
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		var embedded []reflect.Type
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				embedded = append(embedded, field.Type)
+				continue
+			}
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			seen[name] = true
+		}
+		for _, inner := range embedded {
+			collect(inner)
+		}
+	}
+	collect(t)
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		Returns the bridge and tls-client versions, the supported profiles and protocols and the compiled in features
+	*/
+	writeJson(w, buildVersion())
+}
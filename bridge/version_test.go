@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+func TestVersion(t *testing.T) {
+	resp, body := bridgeDo(t, "GET", "/version")
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	output := &VersionOutput{}
+	if err := json.Unmarshal(body, output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Version != bridgeVersion || output.TlsClient == "" {
+		t.Errorf("version %q built with tls-client %q", output.Version, output.TlsClient)
+	}
+	if !slices.Contains(output.Profiles, "chrome_117") {
+		t.Errorf("profiles %v don't include chrome_117", output.Profiles)
+	}
+	for _, option := range []string{"requestUrl", "requestCookies", "parallelRanges"} {
+		if !slices.Contains(output.RequestOptions, option) {
+			t.Errorf("requestOptions %v don't include %s", output.RequestOptions, option)
+		}
+	}
+}
@@ -32,7 +32,7 @@ arch_map = {
 
 class LibraryManager:
     # specify specific version of hrequests-cgo library
-    BRIDGE_VERSION = '1.'
+    BRIDGE_VERSION = '3.'
 
     def __init__(self):
         self.parent_path = os.path.join(root_dir, 'bin')
@@ -127,13 +127,22 @@ def destroySession(session_id: str):
 
 
 # spawn the server
-PORT = GetOpenPort()
-library.StartServer.argtypes = [GoString]
+library.StartServer.argtypes = [GoString, GoString]
+library.StartServer.restype = ctypes.c_void_p
+library.FreeMemory.argtypes = [ctypes.c_void_p]
 
 
-def start_server():
-    encoded_port = str(PORT).encode('utf-8')
-    library.StartServer(GoString(encoded_port, len(encoded_port)))
+def start_server() -> Tuple[int, str]:
+    # port 0 lets the bridge bind a free port itself, so it can't be taken in between
+    # an empty token lets the bridge generate one
+    ptr = library.StartServer(GoString(b'0', 1), GoString(b'', 0))
+    result = loads(ctypes.string_at(ptr))
+    library.FreeMemory(ptr)
+    if result.get('error'):
+        raise OSError(f'Failed to start the hrequests bridge: {result["error"]}')
+    return result['port'], result['token']
 
 
-start_server()
+# port the bridge listens on, and the shared secret it requires on every call
+PORT, TOKEN = start_server()
+AUTH_HEADERS = {'X-Bridge-Token': TOKEN}
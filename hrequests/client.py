@@ -7,7 +7,7 @@ from geventhttpclient import HTTPClient
 from orjson import dumps, loads
 
 import hrequests
-from hrequests.cffi import PORT, destroySession
+from hrequests.cffi import AUTH_HEADERS, PORT, destroySession
 
 from .cookies import (
     RequestsCookieJar,
@@ -244,7 +244,13 @@ class TLSClient:
 
         # http client for local go server
         self.server: HTTPClient = HTTPClient(
-            '127.0.0.1', PORT, ssl=False, insecure=True, connection_timeout=1e9, network_timeout=1e9
+            '127.0.0.1',
+            PORT,
+            ssl=False,
+            insecure=True,
+            connection_timeout=1e9,
+            network_timeout=1e9,
+            headers=AUTH_HEADERS,
         )
         # CookieJar containing all currently outstanding cookies set on this session
         self.cookies: RequestsCookieJar = self.cookies or RequestsCookieJar()
@@ -383,7 +389,10 @@ class TLSClient:
         response_object: dict,
     ):
         if response_object['status'] == 0:
-            raise ClientException(response_object['body'])
+            error = response_object.get('error') or {}
+            raise ClientException(
+                response_object['body'], code=error.get('code'), phase=error.get('phase')
+            )
         # Set response cookies
         response_cookie_jar = extract_cookies_to_jar(
             request_url=url,
@@ -1,6 +1,12 @@
 class ClientException(IOError):
     '''Error with the TLS client'''
 
+    def __init__(self, *args, code=None, phase=None):
+        super().__init__(*args)
+        # machine-readable error code and failing phase reported by the bridge
+        self.code = code
+        self.phase = phase
+
 
 class BrowserException(Exception):
     '''Base exceptions for render instances'''
@@ -3,7 +3,7 @@ from dataclasses import dataclass
 from datetime import datetime, timedelta
 from http.client import responses as status_codes
 from json import detect_encoding
-from typing import Callable, Iterable, List, Literal, Optional, Union
+from typing import Callable, Iterable, List, Literal, Optional, Tuple, Union
 
 from orjson import dumps, loads
 
@@ -78,7 +78,7 @@ class ProcessResponsePool:
     def __init__(self, pool: List[ProcessResponse]) -> None:
         self.pool: List[ProcessResponse] = pool
 
-    def execute_pool(self) -> List['Response']:
+    def build_payloads(self) -> list:
         values: list = []
         for proc in self.pool:
             # get the request data
@@ -92,10 +92,14 @@ class ProcessResponsePool:
             proc.full_headers = headers
             # add to values
             values.append(payload)
+        return values
+
+    def execute_pool(self) -> List['Response']:
+        values: list = self.build_payloads()
         # execute the pool
         try:
             # send request
-            resp = proc.session.server.post(
+            resp = self.pool[-1].session.server.post(
                 f'http://127.0.0.1:{PORT}/multirequest', body=dumps(values)
             )
             response_object = loads(resp.read())
@@ -107,6 +111,30 @@ class ProcessResponsePool:
             for proc, data in zip(self.pool, response_object)
         ]
 
+    def stream_pool(self) -> Iterable[Tuple[int, 'Response']]:
+        '''
+        Yields (index, Response) tuples as each request completes
+        '''
+        values: list = self.build_payloads()
+        try:
+            resp = self.pool[-1].session.server.post(
+                f'http://127.0.0.1:{PORT}/multirequest?stream=true', body=dumps(values)
+            )
+        except Exception as e:
+            raise ClientException('Connection error') from e
+        # one JSON object per line, in completion order
+        while line := resp.readline(b'\n'):
+            if not line.strip():
+                continue
+            try:
+                data = loads(line)
+            except Exception as e:
+                raise ClientException('Invalid response from bridge') from e
+            proc = self.pool[data['index']]
+            yield data['index'], proc.session.build_response(
+                proc.url, proc.full_headers, data['result']
+            )
+
 
 @dataclass
 class Response: